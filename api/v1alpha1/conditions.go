@@ -0,0 +1,33 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+// Condition types maintained in the status of NatsOperator, NatsAccount and NatsUser
+const (
+	// CONDITION_READY is true once the object has been fully reconciled and can be used
+	CONDITION_READY = "Ready"
+	// CONDITION_KEYS_READY is true once the key pairs of the object have been generated or validated
+	CONDITION_KEYS_READY = "KeysReady"
+	// CONDITION_JWT_ISSUED is true once the JWT of the object is signed with the current issuer
+	CONDITION_JWT_ISSUED = "JWTIssued"
+	// CONDITION_PUSHED is true once the current JWT of an account has been pushed to the NATS servers
+	CONDITION_PUSHED = "Pushed"
+	// CONDITION_CONFIG_RENDERED is true once the server configuration snippet of an operator has been rendered
+	CONDITION_CONFIG_RENDERED = "ConfigRendered"
+	// CONDITION_NAMESPACE_ALLOWED is true if the account of a user allows users in the namespace of the user
+	CONDITION_NAMESPACE_ALLOWED = "NamespaceAllowed"
+)
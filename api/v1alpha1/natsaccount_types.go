@@ -67,12 +67,54 @@ type NatsAccountSpec struct {
 	Limits      OperatorLimits     `json:"limits,omitempty"`
 	Revocations jwt.RevocationList `json:"revocations,omitempty"`
 
-	// FIXME: Scoped signing keys
+	// SigningKeys are additional account NKeys that can be selected by a NatsUser via its role.
+	SigningKeys []AccountSigningKey `json:"signingKeys,omitempty"`
+
+	// UserJWTValidity limits the validity of the JWTs of users issued by this account, users are re-issued before
+	// their JWT expires. Revocations of user JWTs are dropped once the revoked JWTs have expired.
+	// If unset, user JWTs never expire.
+	UserJWTValidity *metav1.Duration `json:"userJWTValidity,omitempty"`
+}
+
+// AccountSigningKey defines a signing key of the account, the key pair is generated and stored in a secret
+// named $ACCOUNT-account-sk-$ROLE.
+type AccountSigningKey struct {
+	// Role is the name NatsUser objects use to select this signing key.
+	//+kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Role string `json:"role"`
+	// Template contains the permissions and limits for all users signed with this key.
+	// If no template is given, the signing key is not scoped and users carry their own permissions.
+	Template *UserPermissionLimits `json:"template,omitempty"`
 }
 
-func (s NatsAccountSpec) ToJWTAccount() jwt.Account {
-	exports := lo.Map(s.Exports, func(e Export, _ int) *jwt.Export {
-		return &jwt.Export{
+func (k AccountSigningKey) toNats(publicKey string) jwt.Scope {
+	if k.Template == nil {
+		return nil
+	}
+	scope := jwt.NewUserScope()
+	scope.Key = publicKey
+	scope.Role = k.Role
+	scope.Template = k.Template.toNats()
+	// Zero limits are omitted when encoding and decoded as unlimited, mirror that here.
+	if scope.Template.Subs == 0 {
+		scope.Template.Subs = jwt.NoLimit
+	}
+	if scope.Template.Data == 0 {
+		scope.Template.Data = jwt.NoLimit
+	}
+	if scope.Template.Payload == 0 {
+		scope.Template.Payload = jwt.NoLimit
+	}
+	return scope
+}
+
+// ToJWTAccount creates the account claim, signingKeys contains the generated key pairs for the roles in the spec
+// and revocations the users revoked by the operator in addition to the revocations of the spec.
+func (s NatsAccountSpec) ToJWTAccount(signingKeys []AccountSigningKeyStatus, revocations jwt.RevocationList) jwt.Account {
+	// Keep exports nil if there are none, so the account compares equal to a decoded one
+	var exports []*jwt.Export
+	for _, e := range s.Exports {
+		exports = append(exports, &jwt.Export{
 			Name:                 e.Name,
 			Subject:              e.Subject,
 			Type:                 e.Type,
@@ -84,8 +126,35 @@ func (s NatsAccountSpec) ToJWTAccount() jwt.Account {
 			AccountTokenPosition: e.AccountTokenPosition,
 			Advertise:            e.Advertise,
 			Info:                 e.Info,
+		})
+	}
+	var sk jwt.SigningKeys
+	for _, key := range signingKeys {
+		spec, ok := lo.Find(s.SigningKeys, func(k AccountSigningKey) bool { return k.Role == key.Role })
+		if !ok {
+			continue
+		}
+		if sk == nil {
+			sk = jwt.SigningKeys{}
 		}
-	})
+		if scope := spec.toNats(key.PublicKey); scope != nil {
+			sk.AddScopedSigner(scope)
+		} else {
+			sk.Add(key.PublicKey)
+		}
+	}
+	// Keep revocations nil if there are none, the spec must not be modified while merging
+	var revoked jwt.RevocationList
+	for _, list := range []jwt.RevocationList{s.Revocations, revocations} {
+		for publicKey, at := range list {
+			if revoked == nil {
+				revoked = jwt.RevocationList{}
+			}
+			if at > revoked[publicKey] {
+				revoked[publicKey] = at
+			}
+		}
+	}
 	return jwt.Account{
 		Imports: jwt.Imports(s.Imports),
 		Exports: jwt.Exports(exports),
@@ -95,9 +164,8 @@ func (s NatsAccountSpec) ToJWTAccount() jwt.Account {
 			JetStreamLimits:       s.Limits.JetStreamLimits,
 			JetStreamTieredLimits: s.Limits.JetStreamTieredLimits,
 		},
-		// FIXME: scoped signing keys
-		SigningKeys: jwt.SigningKeys{},
-		Revocations: s.Revocations,
+		SigningKeys: sk,
+		Revocations: revoked,
 	}
 }
 
@@ -106,10 +174,62 @@ type NatsAccountStatus struct {
 	AccountSecretName string `json:"accountSecretName,omitempty"`
 	PublicKey         string `json:"publicKey,omitempty"`
 	JWT               string `json:"jwt,omitempty"`
+	// SigningKeys contains the generated key pairs for the signing keys of the account.
+	SigningKeys []AccountSigningKeyStatus `json:"signingKeys,omitempty"`
+	// Revocations contains the user keys revoked by the operator because the user has been deleted or re-issued.
+	// They are merged with the revocations of the spec into the account JWT. They're kept in the secret of the
+	// account, this lists them for reference.
+	Revocations jwt.RevocationList `json:"revocations,omitempty"`
+	// DeletionJWT is the operator signed request to delete the account from the NATS resolvers.
+	// It is issued once the account is being deleted and sent by the account server.
+	DeletionJWT string `json:"deletionJWT,omitempty"`
+	// Push reports the responses of the NATS servers to the last push of the JWT by the account server.
+	Push *AccountPushStatus `json:"push,omitempty"`
+	// ObservedGeneration is the generation of the spec the status has been computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastIssued is the time the JWT has been issued last
+	LastIssued *metav1.Time `json:"lastIssued,omitempty"`
+	// Conditions describe the current state, see the CONDITION_* constants for the types in use
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// AccountPushStatus reports the responses of the NATS servers to the last push of the account JWT.
+type AccountPushStatus struct {
+	// JWTHash is the hex encoded sha256 hash of the last pushed JWT
+	JWTHash string `json:"jwtHash,omitempty"`
+	// LastPushed is the time the JWT has been pushed last with a different result, repeated pushes with the
+	// same result keep it
+	LastPushed *metav1.Time `json:"lastPushed,omitempty"`
+	// AcceptedBy contains the names of the servers that accepted the JWT
+	AcceptedBy []string `json:"acceptedBy,omitempty"`
+	// RejectedBy contains the servers that rejected the JWT
+	RejectedBy []ServerRejection `json:"rejectedBy,omitempty"`
+}
+
+// ServerRejection is the error a NATS server responded with to a pushed JWT.
+type ServerRejection struct {
+	Server string `json:"server"`
+	Error  string `json:"error"`
+}
+
+// AccountSigningKeyStatus references the generated key pair of an account signing key.
+type AccountSigningKeyStatus struct {
+	Role       string `json:"role"`
+	SecretName string `json:"secretName"`
+	PublicKey  string `json:"publicKey"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Operator",type=string,JSONPath=`.spec.operatorRef.name`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Pushed",type=string,JSONPath=`.status.conditions[?(@.type=="Pushed")].status`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+//+kubebuilder:printcolumn:name="Public Key",type=string,JSONPath=`.status.publicKey`,priority=1
+//+kubebuilder:printcolumn:name="Last Issued",type=date,JSONPath=`.status.lastIssued`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // NatsAccount is the Schema for the natsaccounts API
 type NatsAccount struct {
@@ -37,6 +37,125 @@ type NatsOperatorSpec struct {
 	// SigningKeys is a Slice of other operator NKeys that can be used to sign on behalf of the main
 	// operator identity.
 	SigningKeys jwt.StringList `json:"signing_keys,omitempty"`
+
+	// AccountServerURL is the URL of the account server tools like nsc push accounts to, e.g. https://host:9090/jwt/v1
+	AccountServerURL string `json:"accountServerURL,omitempty"`
+	// OperatorServiceURLs are the NATS URLs tools like nsc connect to, e.g. tls://host:4222
+	OperatorServiceURLs jwt.StringList `json:"operatorServiceURLs,omitempty"`
+	// SystemAccount is the public key of the system account in the operator JWT. It's always the generated
+	// system account $NAME-system, setting it only pins its public key, another key is rejected.
+	SystemAccount string `json:"systemAccount,omitempty"`
+	// StrictSigningKeyUsage requires accounts to be signed by a signing key instead of the operator identity,
+	// so it requires managed signing keys.
+	StrictSigningKeyUsage bool `json:"strictSigningKeyUsage,omitempty"`
+	// AssertServerVersion is the minimum version of the NATS servers, e.g. 2.9.0
+	AssertServerVersion string `json:"assertServerVersion,omitempty"`
+	// Tags are added to the operator JWT
+	Tags jwt.TagList `json:"tags,omitempty"`
+
+	// ManagedSigningKeys are operator signing keys generated by the operator, each stored in a secret
+	// named $NAME-operator-sk-$KEYNAME. They are added to the operator JWT next to SigningKeys.
+	ManagedSigningKeys []OperatorSigningKey `json:"managedSigningKeys,omitempty"`
+	// AccountSigningKey is the name of the managed signing key used to sign all accounts of this operator.
+	// Defaults to the first managed signing key, if there are none, accounts are signed with the operator identity key.
+	AccountSigningKey string `json:"accountSigningKey,omitempty"`
+
+	// OfflineRoot enables the offline root mode: The operator JWT is issued outside of the cluster (e.g. with nsc)
+	// and the cluster only holds the seed of an operator signing key, the identity seed never enters the cluster.
+	OfflineRoot *OfflineRoot `json:"offlineRoot,omitempty"`
+
+	// Resolver configures the account resolver rendered into the server configuration snippet.
+	// Defaults to a full NATS based resolver, invalid combinations of options are reported in the
+	// ConfigRendered condition.
+	Resolver *Resolver `json:"resolver,omitempty"`
+
+	// ConfigTemplate references a Go text/template rendered into the server configuration snippet instead of
+	// the default configuration. Errors of the template are reported in the ConfigRendered condition.
+	ConfigTemplate *ConfigTemplate `json:"configTemplate,omitempty"`
+
+	// TrustedOperators are further operators trusted by the NATS servers using the server configuration snippet
+	// of this operator, e.g. while migrating from another operator. The system account of this operator stays
+	// the system account of the servers.
+	TrustedOperators []TrustedOperator `json:"trustedOperators,omitempty"`
+
+	// AccountServer configures the account server run inside the operator, if it has been started with
+	// --account-servers. It connects with the credentials of the generated system user.
+	AccountServer *AccountServer `json:"accountServer,omitempty"`
+}
+
+// ConfigTemplate references the template of the server configuration snippet in a ConfigMap.
+type ConfigTemplate struct {
+	// ConfigMapName is the name of a ConfigMap in the namespace of the NatsOperator.
+	// The ConfigMap must be labeled nats.deinstapel.de/config-template=true.
+	ConfigMapName string `json:"configMapName"`
+	// Key is the key of the template in the ConfigMap, defaults to auth.conf.tmpl
+	Key string `json:"key,omitempty"`
+}
+
+// TrustedOperator references an operator by the name of its NatsOperator or by its JWT.
+type TrustedOperator struct {
+	// Name is the name of a NatsOperator in the namespace of this operator
+	Name string `json:"name,omitempty"`
+	// JWT is the JWT of an operator managed outside of the cluster, e.g. with nsc
+	JWT string `json:"jwt,omitempty"`
+}
+
+// AccountServer configures the account server run inside the operator.
+type AccountServer struct {
+	// URLs are the seed URLs of the NATS cluster
+	//+kubebuilder:validation:MinItems=1
+	URLs []string `json:"urls"`
+}
+
+const (
+	// RESOLVER_FULL is the NATS based resolver storing all account JWTs on disk
+	RESOLVER_FULL = "full"
+	// RESOLVER_CACHE is the NATS based resolver caching a limited number of account JWTs on disk,
+	// it fetches them from the full resolvers or the account server
+	RESOLVER_CACHE = "cache"
+	// RESOLVER_MEMORY is the resolver serving the account JWTs preloaded into the server configuration,
+	// all ready accounts of the operator are preloaded
+	RESOLVER_MEMORY = "memory"
+	// RESOLVER_URL is the resolver fetching account JWTs from the HTTP endpoint of the account server
+	RESOLVER_URL = "url"
+)
+
+// Resolver selects how NATS servers resolve account JWTs.
+// Unset options are left to the defaults of the NATS servers, except for the defaults listed here.
+type Resolver struct {
+	// Type is the type of the resolver, full, cache, memory or url
+	//+kubebuilder:validation:Enum=full;cache;memory;url
+	//+kubebuilder:default=full
+	Type string `json:"type,omitempty"`
+	// URL is the accounts endpoint of the account server used by the url resolver,
+	// e.g. http://nats-account-server:9090/jwt/v1/accounts/
+	URL string `json:"url,omitempty"`
+	// Dir is the directory the full and cache resolvers store the account JWTs in, defaults to ./jwt
+	Dir string `json:"dir,omitempty"`
+	// Interval is the interval the full resolver syncs its account JWTs with the other servers in, defaults to 2m
+	Interval string `json:"interval,omitempty"`
+	// Timeout is the timeout of account lookups of the full and cache resolvers, defaults to 5s
+	Timeout string `json:"timeout,omitempty"`
+	// AllowDelete allows the deletion of accounts from the full resolver, defaults to true
+	AllowDelete *bool `json:"allowDelete,omitempty"`
+	// Limit is the maximum number of account JWTs stored by the full and cache resolvers
+	//+kubebuilder:validation:Minimum=1
+	Limit int `json:"limit,omitempty"`
+	// TTL is the time the cache resolver keeps account JWTs for
+	TTL string `json:"ttl,omitempty"`
+}
+
+// OfflineRoot references the pre-signed operator JWT and the signing key used for accounts.
+type OfflineRoot struct {
+	// SecretName is the name of a secret in the namespace of the NatsOperator.
+	// It must contain the operator JWT in key.jwt and the seed of a signing key listed in that JWT in seed.nk.
+	SecretName string `json:"secretName"`
+}
+
+// OperatorSigningKey defines an operator signing key that's generated by the operator.
+type OperatorSigningKey struct {
+	//+kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
 }
 
 // NatsOperatorStatus defines the observed state of NatsOperator
@@ -47,10 +166,54 @@ type NatsOperatorStatus struct {
 	// PublicKey is the root public key used to sign all other accounts
 	PublicKey string `json:"publicKey,omitempty"`
 	JWT       string `json:"jwt,omitempty"`
+
+	// SigningKeys contains the generated key pairs of the managed signing keys
+	SigningKeys []OperatorSigningKeyStatus `json:"signingKeys,omitempty"`
+	// SignerSecretName contains the name of the secret with the seed that is used to sign accounts
+	SignerSecretName string `json:"signerSecretName,omitempty"`
+	// SignerPublicKey is the public key of the seed that is used to sign accounts
+	SignerPublicKey string `json:"signerPublicKey,omitempty"`
+	// SigningKeyRotation reports the progress of re-issuing all accounts after the account signing key changed.
+	// It is only set while there are accounts left that are signed by another key.
+	SigningKeyRotation *SigningKeyRotationStatus `json:"signingKeyRotation,omitempty"`
+	// ObservedGeneration is the generation of the spec the status has been computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastIssued is the time the JWT has been issued last
+	LastIssued *metav1.Time `json:"lastIssued,omitempty"`
+	// Conditions describe the current state, see the CONDITION_* constants for the types in use
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// SigningKeyRotationStatus lists the accounts that still need to be re-issued with the current signer.
+type SigningKeyRotationStatus struct {
+	// Reissued is the number of accounts that are already signed by the current signer
+	Reissued int `json:"reissued"`
+	// PendingAccounts contains the names of the accounts still signed by another key
+	PendingAccounts []string `json:"pendingAccounts,omitempty"`
+}
+
+// OperatorSigningKeyStatus references the generated key pair of a managed operator signing key.
+type OperatorSigningKeyStatus struct {
+	Name       string `json:"name"`
+	SecretName string `json:"secretName"`
+	PublicKey  string `json:"publicKey"`
+	// Accounts is the number of accounts currently signed by this key. For retiring keys, it includes
+	// re-issued accounts that haven't been pushed yet.
+	Accounts int `json:"accounts"`
+	// Retiring is set for keys that have been removed from the spec, they're kept in the operator JWT
+	// until no account is signed by them anymore and all re-issued accounts have been pushed.
+	Retiring bool `json:"retiring,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+//+kubebuilder:printcolumn:name="Public Key",type=string,JSONPath=`.status.publicKey`,priority=1
+//+kubebuilder:printcolumn:name="Last Issued",type=date,JSONPath=`.status.lastIssued`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // NatsOperator is the Schema for the natsoperators API
 type NatsOperator struct {
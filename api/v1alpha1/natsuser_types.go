@@ -52,14 +52,31 @@ func (p Permission) toNats() jwt.Permission {
 	}
 }
 
+// Copied from nats-io/jwt to get codegen
+type UserPermissionLimits struct {
+	Permissions            Permissions    `json:"permissions,omitempty"`
+	Limits                 Limits         `json:"limits,omitempty"`
+	BearerToken            bool           `json:"bearer_token,omitempty"`
+	AllowedConnectionTypes jwt.StringList `json:"allowed_connection_types,omitempty"`
+}
+
+func (u UserPermissionLimits) toNats() jwt.UserPermissionLimits {
+	return jwt.UserPermissionLimits{
+		Permissions:            u.Permissions.toNats(),
+		Limits:                 u.Limits.toNats(),
+		BearerToken:            u.BearerToken,
+		AllowedConnectionTypes: u.AllowedConnectionTypes,
+	}
+}
+
 // NatsUserSpec defines the desired state of NatsUser
 type NatsUserSpec struct {
 	// AccountRef is the reference to the account that should sign this user
-	AccountRef             corev1.ObjectReference `json:"accountRef"`
-	Permissions            Permissions            `json:"permissions,omitempty"`
-	Limits                 Limits                 `json:"limits,omitempty"`
-	BearerToken            bool                   `json:"bearer_token,omitempty"`
-	AllowedConnectionTypes jwt.StringList         `json:"allowed_connection_types,omitempty"`
+	AccountRef corev1.ObjectReference `json:"accountRef"`
+	// SigningKeyRole selects a signing key of the referenced account to sign this user.
+	// If the signing key has a template, the permissions and limits of this user are taken from it.
+	SigningKeyRole       string `json:"signingKeyRole,omitempty"`
+	UserPermissionLimits `json:",inline"`
 }
 
 type UserLimits struct {
@@ -89,12 +106,7 @@ func (l Limits) toNats() jwt.Limits {
 }
 func (s NatsUserSpec) ToNatsJWT() jwt.User {
 	return jwt.User{
-		UserPermissionLimits: jwt.UserPermissionLimits{
-			Permissions:            s.Permissions.toNats(),
-			Limits:                 s.Limits.toNats(),
-			BearerToken:            s.BearerToken,
-			AllowedConnectionTypes: s.AllowedConnectionTypes,
-		},
+		UserPermissionLimits: s.UserPermissionLimits.toNats(),
 	}
 }
 
@@ -103,10 +115,24 @@ type NatsUserStatus struct {
 	UserSecretName string `json:"userSecretName,omitempty"`
 	PublicKey      string `json:"publicKey,omitempty"`
 	JWT            string `json:"jwt,omitempty"`
+	// ObservedGeneration is the generation of the spec the status has been computed for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastIssued is the time the JWT has been issued last
+	LastIssued *metav1.Time `json:"lastIssued,omitempty"`
+	// Conditions describe the current state, see the CONDITION_* constants for the types in use
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Account",type=string,JSONPath=`.spec.accountRef.name`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].reason`
+//+kubebuilder:printcolumn:name="Public Key",type=string,JSONPath=`.status.publicKey`,priority=1
+//+kubebuilder:printcolumn:name="Last Issued",type=date,JSONPath=`.status.lastIssued`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // NatsUser is the Schema for the natsusers API
 type NatsUser struct {
@@ -23,9 +23,109 @@ package v1alpha1
 
 import (
 	v2 "github.com/nats-io/jwt/v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AccountPushStatus) DeepCopyInto(out *AccountPushStatus) {
+	*out = *in
+	if in.LastPushed != nil {
+		in, out := &in.LastPushed, &out.LastPushed
+		*out = (*in).DeepCopy()
+	}
+	if in.AcceptedBy != nil {
+		in, out := &in.AcceptedBy, &out.AcceptedBy
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RejectedBy != nil {
+		in, out := &in.RejectedBy, &out.RejectedBy
+		*out = make([]ServerRejection, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AccountPushStatus.
+func (in *AccountPushStatus) DeepCopy() *AccountPushStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AccountPushStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AccountServer) DeepCopyInto(out *AccountServer) {
+	*out = *in
+	if in.URLs != nil {
+		in, out := &in.URLs, &out.URLs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AccountServer.
+func (in *AccountServer) DeepCopy() *AccountServer {
+	if in == nil {
+		return nil
+	}
+	out := new(AccountServer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AccountSigningKey) DeepCopyInto(out *AccountSigningKey) {
+	*out = *in
+	if in.Template != nil {
+		in, out := &in.Template, &out.Template
+		*out = new(UserPermissionLimits)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AccountSigningKey.
+func (in *AccountSigningKey) DeepCopy() *AccountSigningKey {
+	if in == nil {
+		return nil
+	}
+	out := new(AccountSigningKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AccountSigningKeyStatus) DeepCopyInto(out *AccountSigningKeyStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AccountSigningKeyStatus.
+func (in *AccountSigningKeyStatus) DeepCopy() *AccountSigningKeyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AccountSigningKeyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigTemplate) DeepCopyInto(out *ConfigTemplate) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigTemplate.
+func (in *ConfigTemplate) DeepCopy() *ConfigTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Export) DeepCopyInto(out *Export) {
 	*out = *in
@@ -77,7 +177,7 @@ func (in *NatsAccount) DeepCopyInto(out *NatsAccount) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccount.
@@ -165,6 +265,18 @@ func (in *NatsAccountSpec) DeepCopyInto(out *NatsAccountSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.SigningKeys != nil {
+		in, out := &in.SigningKeys, &out.SigningKeys
+		*out = make([]AccountSigningKey, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.UserJWTValidity != nil {
+		in, out := &in.UserJWTValidity, &out.UserJWTValidity
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccountSpec.
@@ -180,6 +292,34 @@ func (in *NatsAccountSpec) DeepCopy() *NatsAccountSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NatsAccountStatus) DeepCopyInto(out *NatsAccountStatus) {
 	*out = *in
+	if in.SigningKeys != nil {
+		in, out := &in.SigningKeys, &out.SigningKeys
+		*out = make([]AccountSigningKeyStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.Revocations != nil {
+		in, out := &in.Revocations, &out.Revocations
+		*out = make(v2.RevocationList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Push != nil {
+		in, out := &in.Push, &out.Push
+		*out = new(AccountPushStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastIssued != nil {
+		in, out := &in.LastIssued, &out.LastIssued
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsAccountStatus.
@@ -198,7 +338,7 @@ func (in *NatsOperator) DeepCopyInto(out *NatsOperator) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsOperator.
@@ -259,6 +399,46 @@ func (in *NatsOperatorSpec) DeepCopyInto(out *NatsOperatorSpec) {
 		*out = make(v2.StringList, len(*in))
 		copy(*out, *in)
 	}
+	if in.OperatorServiceURLs != nil {
+		in, out := &in.OperatorServiceURLs, &out.OperatorServiceURLs
+		*out = make(v2.StringList, len(*in))
+		copy(*out, *in)
+	}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make(v2.TagList, len(*in))
+		copy(*out, *in)
+	}
+	if in.ManagedSigningKeys != nil {
+		in, out := &in.ManagedSigningKeys, &out.ManagedSigningKeys
+		*out = make([]OperatorSigningKey, len(*in))
+		copy(*out, *in)
+	}
+	if in.OfflineRoot != nil {
+		in, out := &in.OfflineRoot, &out.OfflineRoot
+		*out = new(OfflineRoot)
+		**out = **in
+	}
+	if in.Resolver != nil {
+		in, out := &in.Resolver, &out.Resolver
+		*out = new(Resolver)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigTemplate != nil {
+		in, out := &in.ConfigTemplate, &out.ConfigTemplate
+		*out = new(ConfigTemplate)
+		**out = **in
+	}
+	if in.TrustedOperators != nil {
+		in, out := &in.TrustedOperators, &out.TrustedOperators
+		*out = make([]TrustedOperator, len(*in))
+		copy(*out, *in)
+	}
+	if in.AccountServer != nil {
+		in, out := &in.AccountServer, &out.AccountServer
+		*out = new(AccountServer)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsOperatorSpec.
@@ -274,6 +454,27 @@ func (in *NatsOperatorSpec) DeepCopy() *NatsOperatorSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NatsOperatorStatus) DeepCopyInto(out *NatsOperatorStatus) {
 	*out = *in
+	if in.SigningKeys != nil {
+		in, out := &in.SigningKeys, &out.SigningKeys
+		*out = make([]OperatorSigningKeyStatus, len(*in))
+		copy(*out, *in)
+	}
+	if in.SigningKeyRotation != nil {
+		in, out := &in.SigningKeyRotation, &out.SigningKeyRotation
+		*out = new(SigningKeyRotationStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastIssued != nil {
+		in, out := &in.LastIssued, &out.LastIssued
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsOperatorStatus.
@@ -292,7 +493,7 @@ func (in *NatsUser) DeepCopyInto(out *NatsUser) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsUser.
@@ -349,13 +550,7 @@ func (in *NatsUserList) DeepCopyObject() runtime.Object {
 func (in *NatsUserSpec) DeepCopyInto(out *NatsUserSpec) {
 	*out = *in
 	out.AccountRef = in.AccountRef
-	in.Permissions.DeepCopyInto(&out.Permissions)
-	in.Limits.DeepCopyInto(&out.Limits)
-	if in.AllowedConnectionTypes != nil {
-		in, out := &in.AllowedConnectionTypes, &out.AllowedConnectionTypes
-		*out = make(v2.StringList, len(*in))
-		copy(*out, *in)
-	}
+	in.UserPermissionLimits.DeepCopyInto(&out.UserPermissionLimits)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsUserSpec.
@@ -371,6 +566,17 @@ func (in *NatsUserSpec) DeepCopy() *NatsUserSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NatsUserStatus) DeepCopyInto(out *NatsUserStatus) {
 	*out = *in
+	if in.LastIssued != nil {
+		in, out := &in.LastIssued, &out.LastIssued
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NatsUserStatus.
@@ -383,6 +589,21 @@ func (in *NatsUserStatus) DeepCopy() *NatsUserStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OfflineRoot) DeepCopyInto(out *OfflineRoot) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OfflineRoot.
+func (in *OfflineRoot) DeepCopy() *OfflineRoot {
+	if in == nil {
+		return nil
+	}
+	out := new(OfflineRoot)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *OperatorLimits) DeepCopyInto(out *OperatorLimits) {
 	*out = *in
@@ -408,6 +629,36 @@ func (in *OperatorLimits) DeepCopy() *OperatorLimits {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OperatorSigningKey) DeepCopyInto(out *OperatorSigningKey) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OperatorSigningKey.
+func (in *OperatorSigningKey) DeepCopy() *OperatorSigningKey {
+	if in == nil {
+		return nil
+	}
+	out := new(OperatorSigningKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OperatorSigningKeyStatus) DeepCopyInto(out *OperatorSigningKeyStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OperatorSigningKeyStatus.
+func (in *OperatorSigningKeyStatus) DeepCopy() *OperatorSigningKeyStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OperatorSigningKeyStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Permission) DeepCopyInto(out *Permission) {
 	*out = *in
@@ -455,6 +706,76 @@ func (in *Permissions) DeepCopy() *Permissions {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Resolver) DeepCopyInto(out *Resolver) {
+	*out = *in
+	if in.AllowDelete != nil {
+		in, out := &in.AllowDelete, &out.AllowDelete
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Resolver.
+func (in *Resolver) DeepCopy() *Resolver {
+	if in == nil {
+		return nil
+	}
+	out := new(Resolver)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServerRejection) DeepCopyInto(out *ServerRejection) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServerRejection.
+func (in *ServerRejection) DeepCopy() *ServerRejection {
+	if in == nil {
+		return nil
+	}
+	out := new(ServerRejection)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SigningKeyRotationStatus) DeepCopyInto(out *SigningKeyRotationStatus) {
+	*out = *in
+	if in.PendingAccounts != nil {
+		in, out := &in.PendingAccounts, &out.PendingAccounts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SigningKeyRotationStatus.
+func (in *SigningKeyRotationStatus) DeepCopy() *SigningKeyRotationStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SigningKeyRotationStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TrustedOperator) DeepCopyInto(out *TrustedOperator) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrustedOperator.
+func (in *TrustedOperator) DeepCopy() *TrustedOperator {
+	if in == nil {
+		return nil
+	}
+	out := new(TrustedOperator)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *UserLimits) DeepCopyInto(out *UserLimits) {
 	*out = *in
@@ -479,3 +800,25 @@ func (in *UserLimits) DeepCopy() *UserLimits {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UserPermissionLimits) DeepCopyInto(out *UserPermissionLimits) {
+	*out = *in
+	in.Permissions.DeepCopyInto(&out.Permissions)
+	in.Limits.DeepCopyInto(&out.Limits)
+	if in.AllowedConnectionTypes != nil {
+		in, out := &in.AllowedConnectionTypes, &out.AllowedConnectionTypes
+		*out = make(v2.StringList, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UserPermissionLimits.
+func (in *UserPermissionLimits) DeepCopy() *UserPermissionLimits {
+	if in == nil {
+		return nil
+	}
+	out := new(UserPermissionLimits)
+	in.DeepCopyInto(out)
+	return out
+}
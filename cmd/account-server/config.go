@@ -0,0 +1,136 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/samber/lo"
+	"sigs.k8s.io/yaml"
+
+	"github.com/deinstapel/nats-jwt-operator/controllers"
+)
+
+// config selects the NatsOperator whose accounts are served and how to connect to NATS.
+// It is read from the optional config file, flags take precedence over the file.
+type config struct {
+	Nats controllers.NatsConnection `json:"nats"`
+	// Operator is the name of the NatsOperator whose accounts are served
+	Operator string `json:"operator"`
+	// OperatorNamespace is the namespace of the NatsOperator, defaults to the namespace of the pod
+	OperatorNamespace string `json:"operatorNamespace,omitempty"`
+	// Namespaces are the namespaces watched for NatsAccounts, defaults to the namespace of the operator
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// stringList is a flag that can be repeated and accepts comma separated values. The first value replaces the
+// default of the flag.
+type stringList struct {
+	values *[]string
+	set    bool
+}
+
+func (l *stringList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	if !l.set {
+		*l.values = nil
+		l.set = true
+	}
+	*l.values = append(*l.values, lo.Filter(strings.Split(value, ","), func(v string, _ int) bool { return v != "" })...)
+	return nil
+}
+
+// bindFlags binds the flags of the config, defaulting to the environment variables the account server used before.
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	if url := os.Getenv("NATS_URL"); url != "" {
+		c.Nats.URLs = strings.Split(url, ",")
+	}
+	fs.Var(&stringList{values: &c.Nats.URLs}, "nats-url", "The URL of a NATS server, may be repeated or comma separated. Defaults to $NATS_URL.")
+	fs.StringVar(&c.Nats.Name, "nats-connection-name", "", "The name of the NATS connection.")
+	fs.StringVar(&c.Nats.CredsFile, "nats-creds", os.Getenv("NATS_CREDS_FILE"), "The user credentials file to connect to NATS with. Defaults to $NATS_CREDS_FILE.")
+	fs.StringVar(&c.Nats.NKeySeedFile, "nats-nkey", "", "The file with the user nkey seed to connect to NATS with, instead of user credentials.")
+	fs.StringVar(&c.Nats.TLSCAFile, "nats-tls-ca", "", "The CA certificates to verify the NATS servers with.")
+	fs.StringVar(&c.Nats.TLSCertFile, "nats-tls-cert", "", "The client certificate to connect to NATS with.")
+	fs.StringVar(&c.Nats.TLSKeyFile, "nats-tls-key", "", "The key of the client certificate.")
+	fs.StringVar(&c.Operator, "operator", "", "The name of the NatsOperator whose accounts are served.")
+	fs.StringVar(&c.OperatorNamespace, "operator-namespace", os.Getenv("POD_NAMESPACE"), "The namespace of the NatsOperator. Defaults to $POD_NAMESPACE.")
+	fs.Var(&stringList{values: &c.Namespaces}, "namespace", "A namespace to watch for NatsAccounts, may be repeated or comma separated. Defaults to the namespace of the operator.")
+}
+
+// load reads the config file, keeping the values of the flags that have been set explicitly.
+func (c *config) load(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file := config{}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, field := range map[string]struct{ target, value *string }{
+		"nats-connection-name": {&c.Nats.Name, &file.Nats.Name},
+		"nats-creds":           {&c.Nats.CredsFile, &file.Nats.CredsFile},
+		"nats-nkey":            {&c.Nats.NKeySeedFile, &file.Nats.NKeySeedFile},
+		"nats-tls-ca":          {&c.Nats.TLSCAFile, &file.Nats.TLSCAFile},
+		"nats-tls-cert":        {&c.Nats.TLSCertFile, &file.Nats.TLSCertFile},
+		"nats-tls-key":         {&c.Nats.TLSKeyFile, &file.Nats.TLSKeyFile},
+		"operator":             {&c.Operator, &file.Operator},
+		"operator-namespace":   {&c.OperatorNamespace, &file.OperatorNamespace},
+	} {
+		if !set[name] && *field.value != "" {
+			*field.target = *field.value
+		}
+	}
+	if !set["nats-url"] && len(file.Nats.URLs) > 0 {
+		c.Nats.URLs = file.Nats.URLs
+	}
+	if !set["namespace"] && len(file.Namespaces) > 0 {
+		c.Namespaces = file.Namespaces
+	}
+	return nil
+}
+
+// validate defaults the watched namespaces and rejects incomplete or conflicting settings.
+func (c *config) validate() error {
+	if c.Operator == "" {
+		return fmt.Errorf("the operator is required")
+	}
+	if c.OperatorNamespace == "" {
+		return fmt.Errorf("the namespace of the operator is required")
+	}
+	if len(c.Namespaces) == 0 {
+		c.Namespaces = []string{c.OperatorNamespace}
+	}
+	if !lo.Contains(c.Namespaces, c.OperatorNamespace) {
+		return fmt.Errorf("the namespace %v of the operator must be watched", c.OperatorNamespace)
+	}
+	if err := c.Nats.Validate(); err != nil {
+		return fmt.Errorf("invalid NATS connection: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/deinstapel/nats-jwt-operator/controllers"
+)
+
+func TestConfigLoad(t *testing.T) {
+	file := `nats:
+  urls: ["nats://file:4222"]
+  name: file
+operator: file-operator
+namespaces: [file]
+`
+	for _, tc := range []struct {
+		name   string
+		env    string
+		args   []string
+		file   string
+		expect config
+	}{{
+		name:   "environment",
+		env:    "nats://env-0:4222,nats://env-1:4222",
+		expect: config{Nats: controllers.NatsConnection{URLs: []string{"nats://env-0:4222", "nats://env-1:4222"}}},
+	}, {
+		name:   "flags override the environment",
+		env:    "nats://env:4222",
+		args:   []string{"--nats-url", "nats://flag-0:4222,nats://flag-1:4222", "--nats-url", "nats://flag-2:4222"},
+		expect: config{Nats: controllers.NatsConnection{URLs: []string{"nats://flag-0:4222", "nats://flag-1:4222", "nats://flag-2:4222"}}},
+	}, {
+		name:   "file overrides the environment",
+		env:    "nats://env:4222",
+		file:   file,
+		expect: config{Nats: controllers.NatsConnection{URLs: []string{"nats://file:4222"}, Name: "file"}, Operator: "file-operator", Namespaces: []string{"file"}},
+	}, {
+		name:   "flags override the file",
+		args:   []string{"--nats-url", "nats://flag:4222", "--operator", "flag-operator", "--namespace", "flag"},
+		file:   file,
+		expect: config{Nats: controllers.NatsConnection{URLs: []string{"nats://flag:4222"}, Name: "file"}, Operator: "flag-operator", Namespaces: []string{"flag"}},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("NATS_URL", tc.env)
+			t.Setenv("NATS_CREDS_FILE", "")
+			t.Setenv("POD_NAMESPACE", "")
+			cfg := config{}
+			fs := flag.NewFlagSet("account-server", flag.ContinueOnError)
+			cfg.bindFlags(fs)
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			if tc.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tc.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if err := cfg.load(fs, path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(cfg, tc.expect) {
+				t.Errorf("expected %+v, got %+v", tc.expect, cfg)
+			}
+		})
+	}
+
+	cfg := config{}
+	fs := flag.NewFlagSet("account-server", flag.ContinueOnError)
+	cfg.bindFlags(fs)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("unknown: field\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.load(fs, path); err == nil {
+		t.Error("unknown fields in the config file must be rejected")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	nats := controllers.NatsConnection{URLs: []string{"nats://nats:4222"}}
+	for _, tc := range []struct {
+		name       string
+		cfg        config
+		valid      bool
+		namespaces []string
+	}{
+		{name: "defaults the namespaces", cfg: config{Nats: nats, Operator: "operator", OperatorNamespace: "nats"}, valid: true, namespaces: []string{"nats"}},
+		{name: "watches further namespaces", cfg: config{Nats: nats, Operator: "operator", OperatorNamespace: "nats", Namespaces: []string{"nats", "apps"}}, valid: true, namespaces: []string{"nats", "apps"}},
+		{name: "missing operator", cfg: config{Nats: nats, OperatorNamespace: "nats"}},
+		{name: "missing operator namespace", cfg: config{Nats: nats, Operator: "operator"}},
+		{name: "operator namespace not watched", cfg: config{Nats: nats, Operator: "operator", OperatorNamespace: "nats", Namespaces: []string{"apps"}}},
+		{name: "invalid connection", cfg: config{Operator: "operator", OperatorNamespace: "nats"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.validate()
+			if tc.valid && err != nil {
+				t.Fatalf("expected a valid config, got %v", err)
+			} else if !tc.valid && err == nil {
+				t.Fatal("expected the config to be rejected")
+			}
+			if tc.valid && !reflect.DeepEqual(tc.cfg.Namespaces, tc.namespaces) {
+				t.Errorf("expected namespaces %v, got %v", tc.namespaces, tc.cfg.Namespaces)
+			}
+		})
+	}
+}
@@ -18,16 +18,20 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"golang.org/x/time/rate"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -50,9 +54,21 @@ func init() {
 
 func main() {
 	var metricsAddr string
+	var enableLeaderElection bool
 	var probeAddr string
+	var configFile string
+	cfg := config{}
+	var httpAddr string
+	var pushRate float64
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8082", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8083", "The address the probe endpoint binds to.")
+	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
+		"Enable leader election to run multiple replicas. "+
+			"Every replica answers lookups, only the leader pushes accounts to the NATS servers.")
+	flag.StringVar(&httpAddr, "http-bind-address", ":9090", "The address the HTTP endpoint for URL resolvers binds to, empty to disable it.")
+	flag.Float64Var(&pushRate, "push-rate", controllers.ACCOUNT_SERVER_PUSH_RATE, "The number of accounts pushed per second while resyncing after a (re)connect to NATS.")
+	flag.StringVar(&configFile, "config", "", "The optional config file, flags take precedence over it.")
+	cfg.bindFlags(flag.CommandLine)
 	opts := zap.Options{
 		Development: true,
 	}
@@ -61,30 +77,65 @@ func main() {
 	mainContext := ctrl.SetupSignalHandler()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if configFile != "" {
+		if err := cfg.load(flag.CommandLine, configFile); err != nil {
+			setupLog.Error(err, "unable to load config")
+			os.Exit(1)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         false,
-		Namespace:              os.Getenv("POD_NAMESPACE"),
-	})
+		LeaderElection:         enableLeaderElection,
+		LeaderElectionID:       fmt.Sprintf("%v.account-server.deinstapel.de", cfg.Operator),
+		// The account server ends immediately after the manager stopped
+		LeaderElectionReleaseOnCancel: true,
+	}
+	if len(cfg.Namespaces) == 1 {
+		options.Namespace = cfg.Namespaces[0]
+	} else {
+		options.NewCache = cache.MultiNamespacedCacheBuilder(cfg.Namespaces)
+	}
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
-	accountServer := controllers.NewAccountServer()
+	if err := controllers.SetupAccountServerFieldIndexes(mainContext, mgr); err != nil {
+		setupLog.Error(err, "unable to set up field indexes")
+		os.Exit(1)
+	}
+	accountServer := controllers.NewAccountServer(client.ObjectKey{
+		Namespace: cfg.OperatorNamespace,
+		Name:      cfg.Operator,
+	})
+	accountServer.PushRate = rate.Limit(pushRate)
 	accountServer.Scheme = mgr.GetScheme()
 	accountServer.Client = mgr.GetClient()
 
 	go func() {
-		if err := accountServer.Run(mainContext, os.Getenv("NATS_URL"), os.Getenv("NATS_CREDS_FILE")); err != nil {
+		if err := accountServer.Run(mainContext, cfg.Nats); err != nil {
 			setupLog.Error(err, "Failed to run accountserver")
 			os.Exit(1)
 		}
 	}()
 
+	if httpAddr != "" {
+		go func() {
+			if err := accountServer.RunHTTP(mainContext, httpAddr); err != nil {
+				setupLog.Error(err, "Failed to run http endpoint")
+				os.Exit(1)
+			}
+		}()
+	}
+
 	if err = accountServer.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NatsAccount")
 		os.Exit(1)
@@ -94,7 +145,7 @@ func main() {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	if err := mgr.AddReadyzCheck("readyz", accountServer.ReadyzCheck(mgr.GetCache())); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
@@ -19,15 +19,19 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
@@ -52,11 +56,20 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var operatorConcurrency, accountConcurrency, userConcurrency int
+	var accountServers bool
+	var deletionTimeout time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&operatorConcurrency, "max-concurrent-operator-reconciles", 1, "The number of NatsOperators reconciled in parallel.")
+	flag.IntVar(&accountConcurrency, "max-concurrent-account-reconciles", 1, "The number of NatsAccounts reconciled in parallel.")
+	flag.IntVar(&userConcurrency, "max-concurrent-user-reconciles", 1, "The number of NatsUsers reconciled in parallel.")
+	flag.BoolVar(&accountServers, "account-servers", false, "Run the account servers of NatsOperators with an accountServer section inside the operator.")
+	flag.DurationVar(&deletionTimeout, "account-deletion-timeout", controllers.ACCOUNT_SERVER_DELETION_TIMEOUT,
+		"The time a deleted NatsAccount waits for an account server to delete it from the resolvers before it is released.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -72,6 +85,10 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "88cf60bd.deinstapel.de",
+		// Only ConfigMaps with server configuration templates are watched, don't cache all ConfigMaps of the cluster
+		NewCache: cache.BuilderWithOptions(cache.Options{SelectorsByObject: cache.SelectorsByObject{
+			&corev1.ConfigMap{}: {Label: labels.SelectorFromSet(labels.Set{controllers.CONFIG_TEMPLATE_LABEL: "true"})},
+		}}),
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -89,27 +106,49 @@ func main() {
 		os.Exit(1)
 	}
 
+	mainContext := ctrl.SetupSignalHandler()
+	if err = controllers.SetupFieldIndexes(mainContext, mgr); err != nil {
+		setupLog.Error(err, "unable to set up field indexes")
+		os.Exit(1)
+	}
 	if err = (&controllers.NatsOperatorReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Recorder:                mgr.GetEventRecorderFor("natsoperator-controller"),
+		MaxConcurrentReconciles: operatorConcurrency,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NatsOperator")
 		os.Exit(1)
 	}
 	if err = (&controllers.NatsAccountReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Recorder:                mgr.GetEventRecorderFor("natsaccount-controller"),
+		MaxConcurrentReconciles: accountConcurrency,
+		AccountServers:          accountServers,
+		DeletionTimeout:         deletionTimeout,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NatsAccount")
 		os.Exit(1)
 	}
 	if err = (&controllers.NatsUserReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Recorder:                mgr.GetEventRecorderFor("natsuser-controller"),
+		MaxConcurrentReconciles: userConcurrency,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "NatsUser")
 		os.Exit(1)
 	}
+	if accountServers {
+		if err = (&controllers.AccountServerRunner{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "AccountServerRunner")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -122,7 +161,7 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(mainContext); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
@@ -0,0 +1,267 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestAccountDeletion(t *testing.T) {
+	ns := startNatsServer(t)
+	operator, identity, signingKey := issueOperator(t)
+	operator.Namespace = "nats"
+	signingSeed, _ := signingKey.Seed()
+	signerSecret := &corev1.Secret{}
+	signerSecret.Namespace = "nats"
+	signerSecret.Name = "operator-signer"
+	signerSecret.Data = map[string][]byte{OPERATOR_SEED_KEY: signingSeed}
+	operator.Status.SignerSecretName = signerSecret.Name
+	finalizers := []string{JWT_OPERATOR_FINALIZER, ACCOUNT_SERVER_FINALIZER}
+	account := issueAccount(t, signingKey)
+	account.Namespace = "nats"
+	account.Spec.OperatorRef.Name = operator.Name
+	account.Finalizers = finalizers
+	system := issueAccount(t, signingKey)
+	system.Namespace = "nats"
+	system.Name = systemAccountName(client.ObjectKeyFromObject(operator)).Name
+	system.Spec.OperatorRef.Name = operator.Name
+	system.Finalizers = finalizers
+	operatorClaims, err := jwt.DecodeOperatorClaims(operator.Status.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operatorClaims.SystemAccount = system.Status.PublicKey
+	if operator.Status.JWT, err = operatorClaims.Encode(identity); err != nil {
+		t.Fatal(err)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, signerSecret, account, system).Build()
+	accounts := &NatsAccountReconciler{Client: k8s, Scheme: scheme, Recorder: record.NewFakeRecorder(100), AccountServers: true}
+	server := NewAccountServer(client.ObjectKeyFromObject(operator))
+	server.Client = k8s
+	server.Scheme = scheme
+	server.leading.Store(true)
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	server.nc.Store(nc)
+
+	// resolver plays the NATS servers, it rejects the first deletion and confirms the following ones
+	resolver, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	var lock sync.Mutex
+	var deletions []string
+	if _, err := resolver.Subscribe("$SYS.REQ.CLAIMS.DELETE", func(msg *nats.Msg) {
+		lock.Lock()
+		defer lock.Unlock()
+		deletions = append(deletions, string(msg.Data))
+		if len(deletions) == 1 {
+			msg.Respond([]byte(`{"server":{"name":"nats-0"},"error":{"code":500,"description":"resolver unavailable"}}`))
+		} else {
+			msg.Respond([]byte(`{"server":{"name":"nats-0"},"data":{"code":200,"message":"deleted"}}`))
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolver.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	sentDeletions := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, deletions...)
+	}
+
+	ctx := context.Background()
+	reconcile := func(obj *natsv1alpha1.NatsAccount) *natsv1alpha1.NatsAccount {
+		t.Helper()
+		req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(obj)}
+		if _, err := accounts.Reconcile(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		current := &natsv1alpha1.NatsAccount{}
+		if err := k8s.Get(ctx, req.NamespacedName, current); err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+	for _, obj := range []*natsv1alpha1.NatsAccount{account, system} {
+		if err := k8s.Delete(ctx, obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The account controller issues the deletion request before releasing the account
+	deleted := reconcile(account)
+	if controllerutil.ContainsFinalizer(deleted, JWT_OPERATOR_FINALIZER) || !controllerutil.ContainsFinalizer(deleted, ACCOUNT_SERVER_FINALIZER) {
+		t.Fatalf("expected only the finalizer of the account server to be kept, got %v", deleted.Finalizers)
+	}
+	if keys, err := validateDeletion(operator, deleted.Status.DeletionJWT); err != nil || len(keys) != 1 || keys[0] != account.Status.PublicKey {
+		t.Fatalf("expected a valid deletion request for the account, got %v %v", keys, err)
+	}
+
+	// A rejected deletion keeps the finalizer, so it's retried
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)}
+	if _, err := server.Reconcile(ctx, req); err == nil {
+		t.Fatal("expected the rejected deletion to fail")
+	}
+	if err := k8s.Get(ctx, req.NamespacedName, deleted); err != nil {
+		t.Fatalf("expected the account to be kept after a rejected deletion: %v", err)
+	}
+	if _, err := server.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if sent := sentDeletions(); len(sent) != 2 || sent[1] != deleted.Status.DeletionJWT {
+		t.Fatalf("expected the deletion request to be sent twice, got %v requests", len(sent))
+	}
+	if err := k8s.Get(ctx, req.NamespacedName, deleted); !errors.IsNotFound(err) {
+		t.Fatalf("expected the account to be gone once the resolvers confirmed its deletion, got %v", err)
+	}
+
+	// The system account is never deleted from the resolvers
+	deletedSystem := reconcile(system)
+	if deletedSystem.Status.DeletionJWT != "" || controllerutil.ContainsFinalizer(deletedSystem, JWT_OPERATOR_FINALIZER) {
+		t.Fatalf("expected no deletion request for the system account, got finalizers %v", deletedSystem.Finalizers)
+	}
+	if _, err := server.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(system)}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := sentDeletions(); len(sent) != 2 {
+		t.Errorf("expected no deletion request for the system account, got %v requests", len(sent))
+	}
+	if err := k8s.Get(ctx, client.ObjectKeyFromObject(system), deletedSystem); !errors.IsNotFound(err) {
+		t.Fatalf("expected the system account to be released, got %v", err)
+	}
+	systemDeletion := jwt.NewGenericClaims(operatorClaims.SigningKeys[0])
+	systemDeletion.Data["accounts"] = []string{system.Status.PublicKey}
+	token, err := systemDeletion.Encode(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateDeletion(operator, token); err == nil {
+		t.Error("deletion of the system account must be rejected")
+	}
+}
+
+func TestAccountDeletionWithoutServer(t *testing.T) {
+	ns := startNatsServer(t)
+	operator, _, signingKey := issueOperator(t)
+	operator.Namespace = "nats"
+	signingSeed, _ := signingKey.Seed()
+	signerSecret := &corev1.Secret{}
+	signerSecret.Namespace = "nats"
+	signerSecret.Name = "operator-signer"
+	signerSecret.Data = map[string][]byte{OPERATOR_SEED_KEY: signingSeed}
+	operator.Status.SignerSecretName = signerSecret.Name
+	account := issueAccount(t, signingKey)
+	account.Namespace = "nats"
+	account.Spec.OperatorRef.Name = operator.Name
+	account.Finalizers = []string{JWT_OPERATOR_FINALIZER, ACCOUNT_SERVER_FINALIZER}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, signerSecret, account).Build()
+	recorder := record.NewFakeRecorder(100)
+	accounts := &NatsAccountReconciler{Client: k8s, Scheme: scheme, Recorder: recorder, DeletionTimeout: time.Hour}
+	// No resolver is subscribed to the deletion requests
+	server := NewAccountServer(client.ObjectKeyFromObject(operator))
+	server.Client = k8s
+	server.Scheme = scheme
+	server.leading.Store(true)
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	server.nc.Store(nc)
+
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)}
+	if err := k8s.Delete(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+
+	// The account waits for the account server until the timeout
+	result, err := accounts.Reconcile(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter <= 0 || result.RequeueAfter > time.Hour {
+		t.Errorf("expected the account to be requeued until the timeout, got %v", result.RequeueAfter)
+	}
+	if _, err := server.Reconcile(ctx, req); err == nil {
+		t.Fatal("expected the unconfirmed deletion to fail")
+	}
+	deleted := &natsv1alpha1.NatsAccount{}
+	if err := k8s.Get(ctx, req.NamespacedName, deleted); err != nil {
+		t.Fatal(err)
+	}
+	if !controllerutil.ContainsFinalizer(deleted, ACCOUNT_SERVER_FINALIZER) || deleted.Status.DeletionJWT == "" {
+		t.Fatalf("expected the account to wait for the account server, got finalizers %v", deleted.Finalizers)
+	}
+
+	// Once the timeout expired the account is released
+	accounts.DeletionTimeout = time.Nanosecond
+	if _, err := accounts.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := k8s.Get(ctx, req.NamespacedName, deleted); !errors.IsNotFound(err) {
+		t.Fatalf("expected the account to be released after the timeout, got %v", err)
+	}
+	found := false
+	for len(recorder.Events) > 0 {
+		found = found || strings.Contains(<-recorder.Events, "DeletionTimeout")
+	}
+	if !found {
+		t.Error("expected a DeletionTimeout event")
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// ACCOUNT_HTTP_ACCOUNTS_PATH is the path of the accounts endpoint used by the URL resolver of the NATS servers
+const ACCOUNT_HTTP_ACCOUNTS_PATH = "/jwt/v1/accounts/"
+
+// ACCOUNT_HTTP_OPERATOR_PATH is the path of the operator JWT endpoint
+const ACCOUNT_HTTP_OPERATOR_PATH = "/jwt/v1/operator"
+
+// RunHTTP serves the account JWTs over HTTP on addr until the context is done.
+func (r *NatsAccountServer) RunHTTP(ctx context.Context, addr string) error {
+	logger := log.FromContext(ctx)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           r.HTTPHandler(ctx),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	logger.Info("serving accounts over http", "addr", addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// HTTPHandler returns the handler for the account JWT endpoints, compatible with the URL resolver of the NATS servers.
+func (r *NatsAccountServer) HTTPHandler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ACCOUNT_HTTP_ACCOUNTS_PATH, func(w http.ResponseWriter, req *http.Request) {
+		publicKey := strings.TrimPrefix(req.URL.Path, ACCOUNT_HTTP_ACCOUNTS_PATH)
+		accountJWT, ok := r.store.Get(r.Operator, publicKey)
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		serveJWT(w, req, accountJWT)
+	})
+	mux.HandleFunc(ACCOUNT_HTTP_OPERATOR_PATH, func(w http.ResponseWriter, req *http.Request) {
+		operator := &natsv1alpha1.NatsOperator{}
+		if err := r.Get(req.Context(), r.Operator, operator); err != nil || operator.Status.JWT == "" {
+			log.FromContext(ctx).Info("operator jwt not available", "operator", r.Operator, "err", err)
+			http.NotFound(w, req)
+			return
+		}
+		serveJWT(w, req, operator.Status.JWT)
+	})
+	return mux
+}
+
+// serveJWT writes the JWT with an ETag of its hash, answering conditional requests for an unchanged JWT with
+// 304 Not Modified.
+func serveJWT(w http.ResponseWriter, req *http.Request, token string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	etag := `"` + jwtHash(token) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			if candidate = strings.TrimSpace(candidate); candidate == etag || candidate == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/jwt")
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		w.Write([]byte(token))
+	}
+}
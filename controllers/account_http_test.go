@@ -0,0 +1,63 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestHTTPAccounts(t *testing.T) {
+	operator := client.ObjectKey{Namespace: "nats", Name: "a"}
+	server := NewAccountServer(operator)
+	server.store.Set(operator, client.ObjectKey{Namespace: "nats", Name: "app"}, "ACC", "jwt-1")
+	handler := server.HTTPHandler(context.Background())
+
+	get := func(publicKey string, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, ACCOUNT_HTTP_ACCOUNTS_PATH+publicKey, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("UNKNOWN", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown account, got %v", rec.Code)
+	}
+	rec := get("ACC", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "jwt-1" {
+		t.Fatalf("expected jwt-1, got %v %q", rec.Code, rec.Body.String())
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("missing ETag")
+	}
+	if rec := get("ACC", etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching ETag, got %v", rec.Code)
+	}
+
+	server.store.Set(operator, client.ObjectKey{Namespace: "nats", Name: "app"}, "ACC", "jwt-2")
+	if rec := get("ACC", etag); rec.Code != http.StatusOK || rec.Body.String() != "jwt-2" {
+		t.Fatalf("expected re-issued jwt-2, got %v %q", rec.Code, rec.Body.String())
+	}
+}
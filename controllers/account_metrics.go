@@ -0,0 +1,66 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	LOOKUP_RESULT_HIT  = "hit"
+	LOOKUP_RESULT_MISS = "miss"
+	// LOOKUP_ACCOUNT_UNKNOWN is the account label of misses, the account ids of misses are arbitrary subjects
+	LOOKUP_ACCOUNT_UNKNOWN = "unknown"
+
+	PUSH_RESULT_ACCEPTED    = "accepted"
+	PUSH_RESULT_REJECTED    = "rejected"
+	PUSH_RESULT_UNCONFIRMED = "unconfirmed"
+	PUSH_RESULT_ERROR       = "error"
+)
+
+var (
+	accountLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nats_account_server_lookups_total",
+		Help: "Number of account JWT lookups by NATS servers, by served account or unknown and whether the account is served",
+	}, []string{"operator", "account", "result"})
+
+	accountLookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nats_account_server_lookup_duration_seconds",
+		Help:    "Time to answer account JWT lookups by NATS servers",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"operator"})
+
+	accountPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nats_account_server_pushes_total",
+		Help: "Number of account JWTs pushed to the NATS servers, by the result of the push",
+	}, []string{"operator", "result"})
+
+	natsReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nats_account_server_reconnects_total",
+		Help: "Number of reconnects of the account server to NATS",
+	}, []string{"operator"})
+
+	accountsServed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nats_account_server_accounts",
+		Help: "Number of accounts served",
+	}, []string{"operator"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(accountLookups, accountLookupDuration, accountPushes, natsReconnects, accountsServed)
+}
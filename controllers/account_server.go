@@ -17,59 +17,359 @@ limitations under the License.
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/time/rate"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/lo"
 )
 
+const ACCOUNT_SERVER_FINALIZER = "nats.deinstapel.de/account-server"
+
+// IN_PROCESS_ACCOUNT_SERVER_FINALIZER is added by the account servers running inside the operator instead, it's
+// removed again once the account server of the operator has been stopped
+const IN_PROCESS_ACCOUNT_SERVER_FINALIZER = "nats.deinstapel.de/in-process-account-server"
+
+// ACCOUNT_SERVER_DELETION_TIMEOUT is the default time a deleted account waits for an account server to delete it
+// from the resolvers. The finalizers of the account servers are removed afterwards, as the servers might be gone or
+// can't reach NATS.
+const ACCOUNT_SERVER_DELETION_TIMEOUT = 10 * time.Minute
+
+// ACCOUNT_SERVER_RESPONSE_TIMEOUT is the time to collect the responses of all servers of the cluster to a request
+const ACCOUNT_SERVER_RESPONSE_TIMEOUT = 2 * time.Second
+
+// ACCOUNT_LOOKUP_SUBJECT is the subject NATS servers look up account JWTs on
+const ACCOUNT_LOOKUP_SUBJECT = "$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP"
+
+// ACCOUNT_SERVER_QUEUE is the queue group of all account server replicas
+const ACCOUNT_SERVER_QUEUE = "nats-jwt-operator-account-server"
+
+// ACCOUNT_SERVER_PUSH_RATE is the default number of accounts pushed per second while resyncing
+const ACCOUNT_SERVER_PUSH_RATE = 10
+
+// ACCOUNT_SERVER_NAME is the name of the account server in the NATS connection and in its responses
+const ACCOUNT_SERVER_NAME = "nats-jwt-operator-account-server"
+
+// listResponse is the response to a claims list request
+type listResponse struct {
+	Server struct {
+		Name string `json:"name"`
+	} `json:"server"`
+	Data []string `json:"data"`
+}
+
+// claimsResponse is the response of a NATS server to a claims update or delete request
+type claimsResponse struct {
+	Server struct {
+		Name string `json:"name"`
+	} `json:"server"`
+	Data *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"data,omitempty"`
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
 // NatsAccountServer takes NatsAccount and serves them to a nats server (cluster)
 type NatsAccountServer struct {
 	client.Client
-	Scheme     *runtime.Scheme
-	accountMap map[string]string
-	nc         *nats.Conn
+	Scheme *runtime.Scheme
+	// Operator is the NatsOperator whose accounts are served
+	Operator client.ObjectKey
+	// PushRate limits the pushes per second while resyncing all accounts after a (re)connect
+	PushRate rate.Limit
+	// Finalizer keeps deleted accounts until the leader has deleted them from the resolvers
+	Finalizer string
+	store     *AccountStore
+	nc        atomic.Pointer[nats.Conn]
+	// lookupSub is the subscription to account lookups, lookups are not answered once it's invalid
+	lookupSub atomic.Pointer[nats.Subscription]
+	// cacheSynced is set once the informer cache has synced
+	cacheSynced atomic.Bool
+	// leading is set while this replica is the leader, only the leader pushes accounts and updates them
+	leading atomic.Bool
+	// resyncs triggers pushing all served accounts
+	resyncs chan struct{}
+	// leaderEvents enqueues all accounts once this replica became the leader
+	leaderEvents chan event.GenericEvent
 }
 
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts/finalizers,verbs=update
+
+//+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsoperators,verbs=get;list;watch
 
-func NewAccountServer() *NatsAccountServer {
+func NewAccountServer(operator client.ObjectKey) *NatsAccountServer {
 	return &NatsAccountServer{
-		accountMap: make(map[string]string),
+		Operator:  operator,
+		PushRate:  ACCOUNT_SERVER_PUSH_RATE,
+		Finalizer: ACCOUNT_SERVER_FINALIZER,
+		store:     NewAccountStore(),
+		resyncs:   make(chan struct{}, 1),
 	}
 }
-func (r *NatsAccountServer) Run(ctx context.Context, url string, credsFile string) error {
+
+// triggerResync schedules pushing all served accounts, unless a resync is pending already.
+func (r *NatsAccountServer) triggerResync() {
+	select {
+	case r.resyncs <- struct{}{}:
+	default:
+	}
+}
+
+// Lead makes this replica the leader until the context is done. Without leader election every replica leads.
+func (r *NatsAccountServer) Lead(ctx context.Context) error {
 	logger := log.FromContext(ctx)
-	logger.Info("Connecting to nats", "server", url)
-	nc, err := nats.Connect(url, nats.UserCredentials(credsFile), nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1), nats.ReconnectWait(1*time.Second))
+	logger.Info("leading account server", "operator", r.Operator)
+	r.leading.Store(true)
+	defer r.leading.Store(false)
+	r.triggerResync()
+	if r.leaderEvents != nil {
+		// Complete the deletions and pushes the previous leader left over
+		accounts, err := r.listAccounts(ctx)
+		if err != nil {
+			return err
+		}
+		for i := range accounts {
+			select {
+			case r.leaderEvents <- event.GenericEvent{Object: &accounts[i]}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// leadAfterSync leads once the informer cache has synced, so Lead and the resync see all accounts of the operator.
+// It returns without leading if the context is done before.
+func (r *NatsAccountServer) leadAfterSync(ctx context.Context, informers cache.Cache) error {
+	if !informers.WaitForCacheSync(ctx) {
+		return nil
+	}
+	return r.Lead(ctx)
+}
+
+func (r *NatsAccountServer) Run(ctx context.Context, connection NatsConnection) error {
+	logger := log.FromContext(ctx)
+	logger.Info("Connecting to nats", "servers", connection.URLs)
+	options, err := connection.Options()
+	if err != nil {
+		return err
+	}
+	options = append(options,
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(1*time.Second),
+		// Accounts changed while disconnected are never pushed by Reconcile, resync all of them on every (re)connect
+		nats.ConnectHandler(func(_ *nats.Conn) { r.triggerResync() }),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			natsReconnects.WithLabelValues(r.Operator.String()).Inc()
+			r.triggerResync()
+		}),
+	)
+	nc, err := nats.Connect(connection.Servers(), options...)
 	if err != nil {
 		return err
 	}
-	r.nc = nc
-	logger.Info("subscribing to account lookup")
-	sub, err := nc.Subscribe("$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP", func(msg *nats.Msg) {
+	defer nc.Close()
+	r.nc.Store(nc)
+	go r.runResync(ctx)
+	logger.Info("subscribing to account resolver requests")
+	// Requests are answered by a single replica of the queue group. It is not the "responder" queue group of the
+	// servers, the account server always answers as the source of truth.
+	handlers := map[string]nats.MsgHandler{
+		ACCOUNT_LOOKUP_SUBJECT: r.handleLookup(ctx),
+		"$SYS.REQ.CLAIMS.LIST": r.handleList(ctx),
+		"$SYS.REQ.CLAIMS.PACK": r.handlePack(ctx),
+	}
+	subs := []*nats.Subscription{}
+	defer func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}()
+	for subject, handler := range handlers {
+		sub, err := nc.QueueSubscribe(subject, ACCOUNT_SERVER_QUEUE, handler)
+		if err != nil {
+			return err
+		}
+		subs = append(subs, sub)
+		if subject == ACCOUNT_LOOKUP_SUBJECT {
+			r.lookupSub.Store(sub)
+		}
+	}
+	// Every replica drops deleted accounts from its store
+	sub, err := nc.Subscribe("$SYS.REQ.CLAIMS.DELETE", r.handleDelete(ctx))
+	if err != nil {
+		return err
+	}
+	subs = append(subs, sub)
+	<-ctx.Done()
+	return nil
+}
+
+// ReadyzCheck fails while the account server can't serve accounts: it's not connected to NATS, the lookup
+// subscription is not active or the informer cache has not synced yet.
+func (r *NatsAccountServer) ReadyzCheck(informers cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		nc := r.nc.Load()
+		if nc == nil {
+			return fmt.Errorf("not connected to NATS")
+		}
+		if status := nc.Status(); status != nats.CONNECTED {
+			return fmt.Errorf("NATS connection is %v", status)
+		}
+		if sub := r.lookupSub.Load(); sub == nil || !sub.IsValid() {
+			return fmt.Errorf("not subscribed to account lookups")
+		}
+		if !r.cacheSynced.Load() {
+			ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+			defer cancel()
+			if !informers.WaitForCacheSync(ctx) {
+				return fmt.Errorf("informer cache has not synced yet")
+			}
+			r.cacheSynced.Store(true)
+		}
+		return nil
+	}
+}
+
+// handleLookup answers the lookup of a single account JWT.
+func (r *NatsAccountServer) handleLookup(ctx context.Context) nats.MsgHandler {
+	logger := log.FromContext(ctx)
+	return func(msg *nats.Msg) {
+		start := time.Now()
 		accountId := strings.TrimSuffix(strings.TrimPrefix(msg.Subject, "$SYS.REQ.ACCOUNT."), ".CLAIMS.LOOKUP")
 		logger.Info("account lookup", "accountId", accountId)
 
-		accountToken := r.accountMap[accountId]
+		accountToken, ok := r.store.Get(r.Operator, accountId)
+		if ok {
+			accountLookups.WithLabelValues(r.Operator.String(), accountId, LOOKUP_RESULT_HIT).Inc()
+		} else {
+			accountLookups.WithLabelValues(r.Operator.String(), LOOKUP_ACCOUNT_UNKNOWN, LOOKUP_RESULT_MISS).Inc()
+		}
 
 		if err := msg.Respond([]byte(accountToken)); err != nil {
-			logger.Info("Failed to respond to NATS with token: %v", err)
+			logger.Info("Failed to respond to NATS with token", "err", err)
+		}
+		accountLookupDuration.WithLabelValues(r.Operator.String()).Observe(time.Since(start).Seconds())
+	}
+}
+
+// handleList answers with the public keys of all served accounts.
+func (r *NatsAccountServer) handleList(ctx context.Context) nats.MsgHandler {
+	logger := log.FromContext(ctx)
+	return func(msg *nats.Msg) {
+		if msg.Reply == "" {
+			return
+		}
+		accountIds := lo.Keys(r.store.List(r.Operator))
+		sort.Strings(accountIds)
+		response := listResponse{Data: accountIds}
+		response.Server.Name = ACCOUNT_SERVER_NAME
+		data, err := json.Marshal(response)
+		if err != nil {
+			logger.Error(err, "failed encoding list response")
+			return
+		}
+		if err := msg.Respond(data); err != nil {
+			logger.Info("Failed to respond to NATS with account list", "err", err)
+		}
+	}
+}
+
+// handlePack answers the pack request a full resolver uses to synchronize its store. Unless the hash of the
+// requesting resolver matches, all account JWTs are sent as one "<public key>|<jwt>" message each, the response is
+// terminated by an empty message.
+func (r *NatsAccountServer) handlePack(ctx context.Context) nats.MsgHandler {
+	logger := log.FromContext(ctx)
+	return func(msg *nats.Msg) {
+		if msg.Reply == "" {
+			return
+		}
+		hash := r.store.Hash(r.Operator)
+		if !bytes.Equal(msg.Data, hash[:]) {
+			jwts := r.store.List(r.Operator)
+			logger.Info("pack request", "accounts", len(jwts))
+			for publicKey, accountJWT := range jwts {
+				if err := msg.Respond([]byte(fmt.Sprintf("%s|%s", publicKey, accountJWT))); err != nil {
+					// Let the resolver time out, it merges the JWTs it received
+					logger.Info("Failed to respond to NATS with pack", "err", err)
+					return
+				}
+			}
+		}
+		if err := msg.Respond([]byte{}); err != nil {
+			logger.Info("Failed to respond to NATS with end of pack", "err", err)
 		}
-	})
-	if err != nil {
-		return err
 	}
-	<-ctx.Done()
-	return sub.Unsubscribe()
+}
+
+// handleDelete stops serving accounts deleted from the resolvers by a delete request of the operator, e.g. one sent
+// by nsc. The request is answered by the servers only.
+func (r *NatsAccountServer) handleDelete(ctx context.Context) nats.MsgHandler {
+	logger := log.FromContext(ctx)
+	return func(msg *nats.Msg) {
+		operator := &natsv1alpha1.NatsOperator{}
+		if err := r.Get(ctx, r.Operator, operator); err != nil {
+			logger.Info("Failed to get operator for delete request", "err", err)
+			return
+		}
+		publicKeys, err := validateDeletion(operator, string(msg.Data))
+		if err != nil {
+			logger.Info("ignoring delete request", "reason", err)
+			return
+		}
+		for _, publicKey := range publicKeys {
+			logger.Info("account deleted from resolvers", "accountId", publicKey)
+			r.store.DeleteKey(r.Operator, publicKey)
+		}
+		r.updateAccountsServed()
+	}
+}
+
+// updateAccountsServed sets the served accounts metric to the accounts in the store.
+func (r *NatsAccountServer) updateAccountsServed() {
+	accountsServed.WithLabelValues(r.Operator.String()).Set(float64(r.store.Count(r.Operator)))
 }
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
@@ -78,40 +378,408 @@ func (r *NatsAccountServer) Run(ctx context.Context, url string, credsFile strin
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
 func (r *NatsAccountServer) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
+	defer r.updateAccountsServed()
 
 	account := &natsv1alpha1.NatsAccount{}
 	if err := r.Get(ctx, req.NamespacedName, account); err != nil {
 		if errors.IsNotFound(err) {
+			r.store.Delete(r.Operator, req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
 	}
+	if operatorRef(account) != r.Operator {
+		// Issued by another operator, served by another account server
+		r.store.Delete(r.Operator, req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+	nc := r.nc.Load()
+
+	leading := r.leading.Load()
 
 	if account.DeletionTimestamp != nil {
-		// We're not further processing the deletion here.
-		// TODO: correctly handle account revocation
-		delete(r.accountMap, account.Status.PublicKey)
+		if !leading || !controllerutil.ContainsFinalizer(account, r.Finalizer) {
+			// The deletion from the resolvers is left to the leader
+			r.store.Delete(r.Operator, req.NamespacedName)
+			return ctrl.Result{}, nil
+		}
+		if account.Status.DeletionJWT != "" {
+			if nc == nil {
+				return ctrl.Result{RequeueAfter: time.Second}, nil
+			}
+			logger.Info("deleting account from resolvers", "account", account.Name)
+			if err := deleteAccount(nc, account); err != nil {
+				return ctrl.Result{}, err
+			}
+		} else if controllerutil.ContainsFinalizer(account, JWT_OPERATOR_FINALIZER) {
+			// The account controller issues the deletion request before removing its finalizer
+			return ctrl.Result{}, nil
+		} else {
+			logger.Info("no deletion issued for account, it is kept by the resolvers", "account", account.Name)
+		}
+		r.store.Delete(r.Operator, req.NamespacedName)
+		controllerutil.RemoveFinalizer(account, r.Finalizer)
+		return ctrl.Result{}, r.Update(ctx, account)
+	}
+
+	if leading && controllerutil.AddFinalizer(account, r.Finalizer) {
+		if err := r.Update(ctx, account); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if account.Status.JWT == "" || account.Status.PublicKey == "" {
 		return ctrl.Result{}, nil
 	}
+	operator := &natsv1alpha1.NatsOperator{}
+	if err := r.Get(ctx, r.Operator, operator); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := validateIssuer(operator, account); err != nil {
+		// Never serve accounts the NATS servers would reject anyways, the operator watch requeues once it changed
+		logger.Info("not serving account", "account", account.Name, "reason", err)
+		r.store.Delete(r.Operator, req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+	r.store.Set(r.Operator, req.NamespacedName, account.Status.PublicKey, account.Status.JWT)
+	if !leading {
+		// Only the leader pushes accounts, every replica serves them
+		return ctrl.Result{}, nil
+	}
+	if nc == nil || !nc.IsConnected() {
+		// Pushed by the resync once the connection has been (re-)established
+		return ctrl.Result{}, nil
+	}
+	if meta.IsStatusConditionTrue(account.Status.Conditions, natsv1alpha1.CONDITION_PUSHED) {
+		return ctrl.Result{}, nil
+	}
+
+	push, err := r.pushAccount(nc, account)
+	if err != nil {
+		logger.Info("failed to push account", "account", account.Name, "err", err)
+	}
+	if updateErr := r.recordPush(ctx, account, push, err); updateErr != nil {
+		return ctrl.Result{}, updateErr
+	}
+	return ctrl.Result{}, err
+}
 
-	if account.Status.JWT != "" && account.Status.PublicKey != "" {
-		r.accountMap[account.Status.PublicKey] = account.Status.JWT
+// recordPush sets the Pushed condition and the push status of the account to the result of pushing its JWT.
+// The push status is kept if the push failed without any server responding. A repeated result keeps the time of
+// the previous push, so the status is only written once it changed and repeated failures don't requeue the account.
+func (r *NatsAccountServer) recordPush(ctx context.Context, account *natsv1alpha1.NatsAccount, push *natsv1alpha1.AccountPushStatus, pushErr error) error {
+	status := account.Status.DeepCopy()
+	if push != nil && !samePushResult(account.Status.Push, push) {
+		account.Status.Push = push
+	}
+	if pushErr != nil {
+		setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_PUSHED, false, "PushFailed", pushErr.Error())
+	} else {
+		setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_PUSHED, true, "Pushed", "")
+	}
+	if reflect.DeepEqual(status, &account.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, account)
+}
 
-		if r.nc != nil {
-			go func() {
-				if err := r.nc.Publish("$SYS.REQ.CLAIMS.UPDATE", []byte(account.Status.JWT)); err != nil {
-					logger.Info("failed to publish claims update", "account", account.Name, "err", err)
-				}
-			}()
+// runResync pushes all served accounts each time a resync is triggered while leading until the context is done.
+func (r *NatsAccountServer) runResync(ctx context.Context) {
+	logger := log.FromContext(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.resyncs:
+		}
+		if !r.leading.Load() {
+			continue
+		}
+		if err := r.resync(ctx); err != nil && ctx.Err() == nil {
+			logger.Error(err, "failed to resync accounts")
+		}
+	}
+}
+
+// resync pushes the JWTs of all accounts of the operator, limited to PushRate pushes per second, and records the
+// result of each push in the status of the account. The accounts are validated like in Reconcile and added to the
+// store, as a resync right after a restart may run before they have been reconciled.
+func (r *NatsAccountServer) resync(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	nc := r.nc.Load()
+	operator := &natsv1alpha1.NatsOperator{}
+	if err := r.Get(ctx, r.Operator, operator); err != nil {
+		return err
+	}
+	accounts, err := r.listAccounts(ctx)
+	if err != nil {
+		return err
+	}
+	limiter := rate.NewLimiter(r.PushRate, 1)
+	pushed, failed := 0, 0
+	for _, account := range accounts {
+		if account.DeletionTimestamp != nil {
+			continue
+		}
+		if account.Status.JWT == "" || account.Status.PublicKey == "" || validateIssuer(operator, &account) != nil {
+			continue
+		}
+		r.store.Set(r.Operator, client.ObjectKeyFromObject(&account), account.Status.PublicKey, account.Status.JWT)
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		push, pushErr := r.pushAccount(nc, &account)
+		if pushErr != nil {
+			logger.Info("failed to push account", "account", account.Name, "err", pushErr)
+			failed++
+		} else {
+			pushed++
+		}
+		key := client.ObjectKeyFromObject(&account)
+		jwt := account.Status.JWT
+		if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			current := &natsv1alpha1.NatsAccount{}
+			if err := r.Get(ctx, key, current); err != nil {
+				return client.IgnoreNotFound(err)
+			}
+			if current.Status.JWT != jwt {
+				// Re-issued meanwhile, the new JWT is pushed by Reconcile
+				return nil
+			}
+			return r.recordPush(ctx, current, push, pushErr)
+		}); err != nil {
+			logger.Info("failed to record push", "account", account.Name, "err", err)
+		}
+	}
+	logger.Info("resynced accounts", "pushed", pushed, "failed", failed)
+	return nil
+}
+
+// listAccounts lists the accounts issued by the operator. They live in the namespace of the operator, which is one
+// of the namespaces watched by the account server.
+func (r *NatsAccountServer) listAccounts(ctx context.Context) ([]natsv1alpha1.NatsAccount, error) {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(ctx, accounts, client.InNamespace(r.Operator.Namespace), client.MatchingFields{OPERATOR_REF_INDEX: indexKey(r.Operator)}); err != nil {
+		return nil, err
+	}
+	return accounts.Items, nil
+}
+
+// validateIssuer checks that the JWT of the account belongs to the account and has been issued by the operator,
+// either by its identity key or one of its signing keys.
+func validateIssuer(operator *natsv1alpha1.NatsOperator, account *natsv1alpha1.NatsAccount) error {
+	operatorClaims, err := jwt.DecodeOperatorClaims(operator.Status.JWT)
+	if err != nil {
+		return fmt.Errorf("failed decoding jwt of operator %v: %v", operator.Name, err)
+	}
+	accountClaims, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	if err != nil {
+		return fmt.Errorf("failed decoding jwt of account %v: %v", account.Name, err)
+	}
+	if accountClaims.Subject != account.Status.PublicKey {
+		return fmt.Errorf("jwt of account %v has been issued for %v", account.Name, accountClaims.Subject)
+	}
+	if accountClaims.Issuer != operatorClaims.Subject && !operatorClaims.SigningKeys.Contains(accountClaims.Issuer) {
+		return fmt.Errorf("jwt of account %v has been issued by %v, which is not a key of operator %v", account.Name, accountClaims.Issuer, operator.Name)
+	}
+	return nil
+}
+
+// validateDeletion checks a delete request is self signed by a key of the operator and returns the public keys of
+// the accounts to delete.
+func validateDeletion(operator *natsv1alpha1.NatsOperator, deletionJWT string) ([]string, error) {
+	operatorClaims, err := jwt.DecodeOperatorClaims(operator.Status.JWT)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding jwt of operator %v: %v", operator.Name, err)
+	}
+	claims, err := jwt.DecodeGeneric(deletionJWT)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding delete request: %v", err)
+	}
+	if claims.Subject != claims.Issuer {
+		return nil, fmt.Errorf("delete request is not self signed")
+	}
+	if claims.Issuer != operatorClaims.Subject && !operatorClaims.SigningKeys.Contains(claims.Issuer) {
+		return nil, fmt.Errorf("delete request has been issued by %v, which is not a key of operator %v", claims.Issuer, operator.Name)
+	}
+	accounts, ok := claims.Data["accounts"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("malformed delete request")
+	}
+	publicKeys := []string{}
+	for _, entry := range accounts {
+		publicKey, ok := entry.(string)
+		if !ok || !nkeys.IsValidPublicAccountKey(publicKey) {
+			return nil, fmt.Errorf("malformed delete request")
+		}
+		if publicKey == operatorClaims.SystemAccount {
+			return nil, fmt.Errorf("the system account cannot be deleted")
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return publicKeys, nil
+}
+
+// pushAccount sends the JWT of the account to the NATS servers and collects their responses. It fails unless at
+// least one server accepted the JWT and no server rejected it.
+func (r *NatsAccountServer) pushAccount(nc *nats.Conn, account *natsv1alpha1.NatsAccount) (*natsv1alpha1.AccountPushStatus, error) {
+	pushes := accountPushes.MustCurryWith(prometheus.Labels{"operator": r.Operator.String()})
+	responses, err := requestMany(nc, "$SYS.REQ.CLAIMS.UPDATE", []byte(account.Status.JWT), ACCOUNT_SERVER_RESPONSE_TIMEOUT)
+	if err != nil {
+		pushes.WithLabelValues(PUSH_RESULT_ERROR).Inc()
+		return nil, err
+	}
+	push := pushStatus(account.Status.JWT, responses)
+	if len(push.RejectedBy) > 0 {
+		pushes.WithLabelValues(PUSH_RESULT_REJECTED).Inc()
+		rejection := push.RejectedBy[0]
+		return push, fmt.Errorf("rejected by %v server(s), %v: %v", len(push.RejectedBy), rejection.Server, rejection.Error)
+	}
+	if len(push.AcceptedBy) == 0 {
+		pushes.WithLabelValues(PUSH_RESULT_UNCONFIRMED).Inc()
+		return push, fmt.Errorf("no server confirmed the update of account %v", account.Status.PublicKey)
+	}
+	pushes.WithLabelValues(PUSH_RESULT_ACCEPTED).Inc()
+	return push, nil
+}
+
+// pushStatus sorts the responses of the servers to a pushed JWT into accepting and rejecting servers.
+func pushStatus(token string, responses []*nats.Msg) *natsv1alpha1.AccountPushStatus {
+	now := metav1.Now()
+	push := &natsv1alpha1.AccountPushStatus{
+		JWTHash:    jwtHash(token),
+		LastPushed: &now,
+	}
+	for _, msg := range responses {
+		response := claimsResponse{}
+		if err := json.Unmarshal(msg.Data, &response); err != nil {
+			push.RejectedBy = append(push.RejectedBy, natsv1alpha1.ServerRejection{
+				Error: fmt.Sprintf("failed decoding response: %v", err),
+			})
+		} else if response.Error != nil {
+			push.RejectedBy = append(push.RejectedBy, natsv1alpha1.ServerRejection{
+				Server: response.Server.Name,
+				Error:  response.Error.Description,
+			})
+		} else {
+			push.AcceptedBy = append(push.AcceptedBy, response.Server.Name)
 		}
 	}
+	sort.Strings(push.AcceptedBy)
+	sort.Slice(push.RejectedBy, func(i, j int) bool { return push.RejectedBy[i].Server < push.RejectedBy[j].Server })
+	return push
+}
+
+// samePushResult reports whether two pushes of a JWT got the same responses, regardless of their time.
+func samePushResult(previous *natsv1alpha1.AccountPushStatus, push *natsv1alpha1.AccountPushStatus) bool {
+	if previous == nil {
+		return false
+	}
+	unchanged := *push
+	unchanged.LastPushed = previous.LastPushed
+	return reflect.DeepEqual(previous, &unchanged)
+}
+
+// jwtHash returns the hex encoded sha256 hash of a JWT.
+func jwtHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// deleteAccount sends the deletion request of the account to the NATS servers and waits until they confirmed it.
+func deleteAccount(nc *nats.Conn, account *natsv1alpha1.NatsAccount) error {
+	responses, err := requestMany(nc, "$SYS.REQ.CLAIMS.DELETE", []byte(account.Status.DeletionJWT), ACCOUNT_SERVER_RESPONSE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	return checkClaimsResponses(responses, "deletion", account.Status.PublicKey)
+}
 
-	return ctrl.Result{}, nil
+// checkClaimsResponses fails unless at least one server responded and no server rejected the request.
+func checkClaimsResponses(responses []*nats.Msg, action string, publicKey string) error {
+	if len(responses) == 0 {
+		return fmt.Errorf("no server confirmed the %v of account %v", action, publicKey)
+	}
+	for _, msg := range responses {
+		response := claimsResponse{}
+		if err := json.Unmarshal(msg.Data, &response); err != nil {
+			return fmt.Errorf("failed decoding response to %v of account %v: %v", action, publicKey, err)
+		}
+		if response.Error != nil {
+			return fmt.Errorf("server %v rejected %v of account %v: %v", response.Server.Name, action, publicKey, response.Error.Description)
+		}
+	}
+	return nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
+// requestMany sends a request and collects the responses of all servers until the timeout expired.
+func requestMany(nc *nats.Conn, subject string, data []byte, timeout time.Duration) ([]*nats.Msg, error) {
+	inbox := nc.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := nc.PublishRequest(subject, inbox, data); err != nil {
+		return nil, err
+	}
+	var responses []*nats.Msg
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err == nats.ErrTimeout {
+			return responses, nil
+		} else if err != nil {
+			return responses, err
+		}
+		responses = append(responses, msg)
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager. The controller runs on every replica to keep
+// its store in sync, pushing accounts is left to the replica leading through Lead.
 func (r *NatsAccountServer) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&natsv1alpha1.NatsAccount{}).
-		Complete(r)
+	c, err := controller.NewUnmanaged("natsaccountserver", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	r.leaderEvents = make(chan event.GenericEvent)
+	if err := c.Watch(&source.Kind{Type: &natsv1alpha1.NatsAccount{}}, &handler.EnqueueRequestForObject{}); err != nil {
+		return err
+	}
+	if err := c.Watch(&source.Kind{Type: &natsv1alpha1.NatsOperator{}}, handler.EnqueueRequestsFromMapFunc(r.findOperatorAccounts)); err != nil {
+		return err
+	}
+	if err := c.Watch(&source.Channel{Source: r.leaderEvents}, &handler.EnqueueRequestForObject{}); err != nil {
+		return err
+	}
+	if err := mgr.Add(everyReplica{c}); err != nil {
+		return err
+	}
+	return mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		return r.leadAfterSync(ctx, mgr.GetCache())
+	}))
+}
+
+// everyReplica runs a runnable regardless of leader election.
+type everyReplica struct {
+	manager.Runnable
+}
+
+func (everyReplica) NeedLeaderElection() bool {
+	return false
+}
+
+// findOperatorAccounts enqueues all accounts of the served operator, as their issuer is validated against it.
+func (r *NatsAccountServer) findOperatorAccounts(obj client.Object) []reconcile.Request {
+	if client.ObjectKeyFromObject(obj) != r.Operator {
+		return nil
+	}
+	accounts, err := r.listAccounts(context.Background())
+	if err != nil {
+		return nil
+	}
+	return lo.Map(accounts, func(account natsv1alpha1.NatsAccount, _ int) reconcile.Request {
+		return reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&account)}
+	})
 }
@@ -0,0 +1,227 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func startNatsServer(t *testing.T) *server.Server {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeadAfterSync(t *testing.T) {
+	server := NewAccountServer(client.ObjectKey{Namespace: "nats", Name: "operator"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.leadAfterSync(ctx, syncedCache{})
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if server.leading.Load() {
+		t.Error("expected the server not to lead before the cache synced")
+	}
+	cancel()
+	<-done
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go server.leadAfterSync(ctx, syncedCache{synced: true})
+	waitFor(t, "the server to lead", server.leading.Load)
+}
+
+func TestAccountServerFailover(t *testing.T) {
+	ns := startNatsServer(t)
+	operator, _, signingKey := issueOperator(t)
+	operator.Namespace = "nats"
+	account := issueAccount(t, signingKey)
+	account.Namespace = "nats"
+	account.Spec.OperatorRef.Name = operator.Name
+
+	scheme := runtime.NewScheme()
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, account).
+		WithIndex(&natsv1alpha1.NatsAccount{}, OPERATOR_REF_INDEX, operatorRefIndex).Build()
+
+	// resolver plays the NATS servers, it sends lookups and confirms pushes
+	resolver, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	var pushes atomic.Int32
+	if _, err := resolver.Subscribe("$SYS.REQ.CLAIMS.UPDATE", func(msg *nats.Msg) {
+		pushes.Add(1)
+		msg.Respond([]byte(`{"server":{"name":"nats-0"},"data":{"code":200,"message":"jwt updated"}}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func() []*nats.Msg {
+		responses, err := requestMany(resolver, "$SYS.REQ.ACCOUNT."+account.Status.PublicKey+".CLAIMS.LOOKUP", nil, 200*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return responses
+	}
+
+	replica := func() (*NatsAccountServer, context.CancelFunc) {
+		r := NewAccountServer(client.ObjectKeyFromObject(operator))
+		r.Client = k8s
+		r.Scheme = scheme
+		ctx, cancel := context.WithCancel(context.Background())
+		go r.Run(ctx, NatsConnection{URLs: []string{ns.ClientURL()}})
+		waitFor(t, "lookup subscription", func() bool {
+			sub := r.lookupSub.Load()
+			return sub != nil && sub.IsValid()
+		})
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)}); err != nil {
+			t.Fatal(err)
+		}
+		return r, cancel
+	}
+	a, stopA := replica()
+	b, stopB := replica()
+	defer stopB()
+
+	if n := pushes.Load(); n != 0 {
+		t.Fatalf("replicas pushed %v times without leading", n)
+	}
+	leadA, stopLeadA := context.WithCancel(context.Background())
+	go a.Lead(leadA)
+	waitFor(t, "push by the first leader", func() bool { return pushes.Load() == 1 })
+
+	if responses := lookup(); len(responses) != 1 || string(responses[0].Data) != account.Status.JWT {
+		t.Fatalf("expected a single lookup response with the account jwt, got %v", len(responses))
+	}
+
+	// Failover to the second replica
+	stopLeadA()
+	stopA()
+	waitFor(t, "first leader stepping down", func() bool { return !a.leading.Load() })
+	leadB, stopLeadB := context.WithCancel(context.Background())
+	defer stopLeadB()
+	go b.Lead(leadB)
+	waitFor(t, "push by the second leader", func() bool { return pushes.Load() == 2 })
+
+	if responses := lookup(); len(responses) != 1 || string(responses[0].Data) != account.Status.JWT {
+		t.Fatalf("expected a single lookup response after failover, got %v", len(responses))
+	}
+	waitFor(t, "recorded push", func() bool {
+		pushed := &natsv1alpha1.NatsAccount{}
+		if err := k8s.Get(context.Background(), client.ObjectKeyFromObject(account), pushed); err != nil {
+			t.Fatal(err)
+		}
+		return meta.IsStatusConditionTrue(pushed.Status.Conditions, natsv1alpha1.CONDITION_PUSHED)
+	})
+}
+
+func TestResyncAfterRestart(t *testing.T) {
+	ns := startNatsServer(t)
+	operator, _, signingKey := issueOperator(t)
+	operator.Namespace = "nats"
+	account := issueAccount(t, signingKey)
+	account.Namespace = "nats"
+	account.Spec.OperatorRef.Name = operator.Name
+	// Pushed before the restart, the resolver lost it meanwhile
+	setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_PUSHED, true, "Pushed", "")
+	foreign := issueAccount(t, signingKey)
+	foreign.Namespace = "nats"
+	foreign.Name = "foreign"
+	foreign.Spec.OperatorRef.Name = "other"
+
+	scheme := runtime.NewScheme()
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, account, foreign).
+		WithIndex(&natsv1alpha1.NatsAccount{}, OPERATOR_REF_INDEX, operatorRefIndex).Build()
+
+	resolver, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	pushed := make(chan string, 10)
+	if _, err := resolver.Subscribe("$SYS.REQ.CLAIMS.UPDATE", func(msg *nats.Msg) {
+		pushed <- string(msg.Data)
+		msg.Respond([]byte(`{"server":{"name":"nats-0"},"data":{"code":200,"message":"jwt updated"}}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The resync runs before any account has been reconciled
+	r := NewAccountServer(client.ObjectKeyFromObject(operator))
+	r.Client = k8s
+	r.Scheme = scheme
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Lead(ctx)
+	go r.Run(ctx, NatsConnection{URLs: []string{ns.ClientURL()}})
+
+	select {
+	case jwt := <-pushed:
+		if jwt != account.Status.JWT {
+			t.Fatalf("expected the account jwt to be pushed, got %v", jwt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the resync to push the account")
+	}
+	if served, ok := r.store.Get(r.Operator, account.Status.PublicKey); !ok || served != account.Status.JWT {
+		t.Error("expected the resynced account to be served")
+	}
+	select {
+	case jwt := <-pushed:
+		t.Fatalf("expected only the account of the operator to be pushed, got %v", jwt)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// AccountServerRunner runs a NatsAccountServer inside the operator for every NatsOperator with an accountServer
+// section. The servers connect with the credentials of the generated system user and reconnect once they have
+// been re-issued. They use IN_PROCESS_ACCOUNT_SERVER_FINALIZER, which is removed from the accounts of an operator
+// once its server has been stopped.
+type AccountServerRunner struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// cache is the informer cache of the manager, the servers lead once it has synced
+	cache   cache.Cache
+	lock    sync.Mutex
+	servers map[client.ObjectKey]*inProcessAccountServer
+	// accountEvents enqueues the accounts of an operator once its server has been started
+	accountEvents chan event.GenericEvent
+}
+
+type inProcessAccountServer struct {
+	server     *NatsAccountServer
+	connection NatsConnection
+	// stop stops the server, stopRun only its current NATS connection
+	stop    context.CancelFunc
+	stopRun context.CancelFunc
+}
+
+// Reconcile starts, reconnects or stops the account server of a NatsOperator.
+func (r *AccountServerRunner) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	operator := &natsv1alpha1.NatsOperator{}
+	if err := r.Get(ctx, req.NamespacedName, operator); errors.IsNotFound(err) {
+		r.stop(ctx, req.NamespacedName)
+		return ctrl.Result{}, r.releaseAccounts(ctx, req.NamespacedName)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	if operator.Spec.AccountServer == nil || operator.DeletionTimestamp != nil {
+		r.stop(ctx, req.NamespacedName)
+		return ctrl.Result{}, r.releaseAccounts(ctx, req.NamespacedName)
+	}
+
+	// The credentials of the system user, the secret watch enqueues the operator once they have been issued
+	systemUser := &natsv1alpha1.NatsUser{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: fmt.Sprintf("%v-jwt", req.Name)}, systemUser); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if systemUser.Status.UserSecretName == "" {
+		return ctrl.Result{}, nil
+	}
+	credsSecret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: systemUser.Status.UserSecretName}, credsSecret); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	connection := NatsConnection{
+		URLs:  operator.Spec.AccountServer.URLs,
+		Creds: credsSecret.Data[OPERATOR_CREDS],
+	}
+	if len(connection.Creds) == 0 {
+		return ctrl.Result{}, nil
+	}
+	if err := connection.Validate(); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	running, ok := r.servers[req.NamespacedName]
+	if !ok {
+		logger.Info("starting account server", "operator", req.NamespacedName)
+		server := NewAccountServer(req.NamespacedName)
+		server.Client = r.Client
+		server.Scheme = r.Scheme
+		server.Finalizer = IN_PROCESS_ACCOUNT_SERVER_FINALIZER
+		serverCtx, stop := context.WithCancel(context.Background())
+		running = &inProcessAccountServer{server: server, stop: stop}
+		r.servers[req.NamespacedName] = running
+		// The operator is elected already, its account servers always lead
+		go server.leadAfterSync(serverCtx, r.cache)
+		go r.enqueueAccounts(serverCtx, req.NamespacedName)
+	}
+	if running.stopRun == nil || !reflect.DeepEqual(running.connection, connection) {
+		if running.stopRun != nil {
+			logger.Info("reconnecting account server", "operator", req.NamespacedName)
+			running.stopRun()
+		}
+		runCtx, stopRun := context.WithCancel(log.IntoContext(context.Background(), logger))
+		running.connection = connection
+		running.stopRun = stopRun
+		go func() {
+			if err := running.server.Run(runCtx, connection); err != nil {
+				logger.Error(err, "failed to run account server", "operator", req.NamespacedName)
+			}
+		}()
+	}
+	return ctrl.Result{}, nil
+}
+
+// stop stops the account server of the operator, if it's running.
+func (r *AccountServerRunner) stop(ctx context.Context, operator client.ObjectKey) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if running, ok := r.servers[operator]; ok {
+		log.FromContext(ctx).Info("stopping account server", "operator", operator)
+		running.stop()
+		if running.stopRun != nil {
+			running.stopRun()
+		}
+		delete(r.servers, operator)
+	}
+}
+
+// releaseAccounts removes the finalizer of the stopped account server from the accounts of the operator, so their
+// deletion doesn't wait for it.
+func (r *AccountServerRunner) releaseAccounts(ctx context.Context, operator client.ObjectKey) error {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(ctx, accounts, client.MatchingFields{OPERATOR_REF_INDEX: indexKey(operator)}); err != nil {
+		return err
+	}
+	var errs []error
+	for i := range accounts.Items {
+		if err := releaseAccount(ctx, r.Client, &accounts.Items[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// releaseAccount removes the finalizer of the in-process account servers from the account.
+func releaseAccount(ctx context.Context, c client.Client, account *natsv1alpha1.NatsAccount) error {
+	if !controllerutil.RemoveFinalizer(account, IN_PROCESS_ACCOUNT_SERVER_FINALIZER) {
+		return nil
+	}
+	return client.IgnoreNotFound(c.Update(ctx, account))
+}
+
+// stopAll stops all account servers once the manager stops. The finalizers are kept, the servers are started again
+// with the operator.
+func (r *AccountServerRunner) stopAll(ctx context.Context) error {
+	<-ctx.Done()
+	for _, operator := range lo.Keys(r.runningServers()) {
+		r.stop(ctx, operator)
+	}
+	return nil
+}
+
+func (r *AccountServerRunner) runningServers() map[client.ObjectKey]*NatsAccountServer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return lo.MapValues(r.servers, func(running *inProcessAccountServer, _ client.ObjectKey) *NatsAccountServer {
+		return running.server
+	})
+}
+
+// enqueueAccounts fills the store of a started account server with the accounts of its operator.
+func (r *AccountServerRunner) enqueueAccounts(ctx context.Context, operator client.ObjectKey) {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(ctx, accounts, client.MatchingFields{OPERATOR_REF_INDEX: indexKey(operator)}); err != nil {
+		log.FromContext(ctx).Error(err, "failed to list accounts", "operator", operator)
+		return
+	}
+	for i := range accounts.Items {
+		select {
+		case r.accountEvents <- event.GenericEvent{Object: &accounts.Items[i]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcileAccount passes a NatsAccount to all running account servers, each one serves it only if it's been
+// issued by its operator and drops it otherwise. Accounts of operators without a running server are released.
+func (r *AccountServerRunner) reconcileAccount(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	servers := r.runningServers()
+	account := &natsv1alpha1.NatsAccount{}
+	if err := r.Get(ctx, req.NamespacedName, account); err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	} else if err == nil && servers[operatorRef(account)] == nil {
+		if err := releaseAccount(ctx, r.Client, account); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	result := ctrl.Result{}
+	var errs []error
+	for _, server := range servers {
+		serverResult, err := server.Reconcile(ctx, req)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if serverResult.Requeue || serverResult.RequeueAfter > 0 && (result.RequeueAfter == 0 || serverResult.RequeueAfter < result.RequeueAfter) {
+			result = serverResult
+		}
+	}
+	return result, kerrors.NewAggregate(errs)
+}
+
+// SetupWithManager sets up the controllers for NatsOperators and their NatsAccounts with the Manager.
+func (r *AccountServerRunner) SetupWithManager(mgr ctrl.Manager) error {
+	r.cache = mgr.GetCache()
+	r.servers = make(map[client.ObjectKey]*inProcessAccountServer)
+	r.accountEvents = make(chan event.GenericEvent)
+	if err := ctrl.NewControllerManagedBy(mgr).
+		Named("natsoperator-accountserver").
+		For(&natsv1alpha1.NatsOperator{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(findSystemUserOperator)).
+		Complete(r); err != nil {
+		return err
+	}
+	if err := ctrl.NewControllerManagedBy(mgr).
+		Named("natsaccount-accountserver").
+		For(&natsv1alpha1.NatsAccount{}).
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsOperator{}}, handler.EnqueueRequestsFromMapFunc(r.findOperatorAccounts)).
+		Watches(&source.Channel{Source: r.accountEvents}, &handler.EnqueueRequestForObject{}).
+		Complete(reconcile.Func(r.reconcileAccount)); err != nil {
+		return err
+	}
+	return mgr.Add(manager.RunnableFunc(r.stopAll))
+}
+
+// findSystemUserOperator enqueues the operator of a system user credentials secret, named $NAME-jwt.
+func findSystemUserOperator(obj client.Object) []reconcile.Request {
+	if !strings.HasSuffix(obj.GetName(), "-jwt") {
+		return nil
+	}
+	name := strings.TrimSuffix(obj.GetName(), "-jwt")
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: name}}}
+}
+
+// findOperatorAccounts enqueues all accounts of an operator, as their issuer is validated against it.
+func (r *AccountServerRunner) findOperatorAccounts(obj client.Object) []reconcile.Request {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(context.Background(), accounts, client.MatchingFields{OPERATOR_REF_INDEX: indexKey(client.ObjectKeyFromObject(obj))}); err != nil {
+		return nil
+	}
+	return lo.Map(accounts.Items, func(account natsv1alpha1.NatsAccount, _ int) reconcile.Request {
+		return reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&account)}
+	})
+}
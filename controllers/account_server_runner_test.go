@@ -0,0 +1,198 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// syncedCache is an informer cache that has synced already or never syncs.
+type syncedCache struct {
+	cache.Cache
+	synced bool
+}
+
+func (c syncedCache) WaitForCacheSync(ctx context.Context) bool {
+	if !c.synced {
+		<-ctx.Done()
+	}
+	return c.synced
+}
+
+func issueCreds(t *testing.T) []byte {
+	user, _ := nkeys.CreateUser()
+	public, _ := user.PublicKey()
+	account, _ := nkeys.CreateAccount()
+	token, err := jwt.NewUserClaims(public).Encode(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, _ := user.Seed()
+	creds, err := jwt.FormatUserConfig(token, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creds
+}
+
+func TestAccountServerRunnerReconnect(t *testing.T) {
+	ns := startNatsServer(t)
+	operator, _, signingKey := issueOperator(t)
+	operator.Namespace = "nats"
+	operator.Spec.AccountServer = &natsv1alpha1.AccountServer{URLs: []string{ns.ClientURL()}}
+	systemUser := &natsv1alpha1.NatsUser{}
+	systemUser.Namespace = "nats"
+	systemUser.Name = "operator-jwt"
+	systemUser.Status.UserSecretName = "operator-jwt"
+	secret := &corev1.Secret{}
+	secret.Namespace = "nats"
+	secret.Name = "operator-jwt"
+	secret.Data = map[string][]byte{OPERATOR_CREDS: issueCreds(t)}
+	account := issueAccount(t, signingKey)
+	account.Namespace = "nats"
+	account.Spec.OperatorRef.Name = operator.Name
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, systemUser, secret, account).
+		WithIndex(&natsv1alpha1.NatsAccount{}, OPERATOR_REF_INDEX, operatorRefIndex).Build()
+	r := &AccountServerRunner{Client: k8s, Scheme: scheme, cache: syncedCache{synced: true}, servers: map[client.ObjectKey]*inProcessAccountServer{}}
+	defer r.stopAll(canceledContext())
+
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(operator)}
+	resolver, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	if _, err := resolver.Subscribe("$SYS.REQ.CLAIMS.UPDATE", func(msg *nats.Msg) {
+		msg.Respond([]byte(`{"server":{"name":"nats-0"},"data":{"code":200,"message":"jwt updated"}}`))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	connected := func() *nats.Conn {
+		server := r.runningServers()[req.NamespacedName]
+		if server == nil {
+			return nil
+		}
+		if nc := server.nc.Load(); nc != nil && nc.IsConnected() {
+			return nc
+		}
+		return nil
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "account server connection", func() bool { return connected() != nil })
+	first := connected()
+	hasFinalizer := func() bool {
+		current := &natsv1alpha1.NatsAccount{}
+		if err := k8s.Get(ctx, client.ObjectKeyFromObject(account), current); err != nil {
+			t.Fatal(err)
+		}
+		return controllerutil.ContainsFinalizer(current, IN_PROCESS_ACCOUNT_SERVER_FINALIZER)
+	}
+	accountReq := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(account)}
+	waitFor(t, "account server leading", func() bool { return r.runningServers()[req.NamespacedName].leading.Load() })
+	// Conflicts with the resync of the started server are retried
+	waitFor(t, "account reconciled", func() bool {
+		_, err := r.reconcileAccount(ctx, accountReq)
+		return err == nil
+	})
+	if !hasFinalizer() {
+		t.Fatal("expected the running account server to add its finalizer")
+	}
+
+	// Unchanged credentials keep the connection
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if connected() != first {
+		t.Fatal("account server reconnected with unchanged credentials")
+	}
+
+	// Re-issued credentials reconnect
+	secret.Data[OPERATOR_CREDS] = issueCreds(t)
+	if err := k8s.Update(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "account server reconnect", func() bool {
+		nc := connected()
+		return nc != nil && nc != first && first.IsClosed()
+	})
+
+	// Removing the accountServer section stops the server
+	operator.Spec.AccountServer = nil
+	if err := k8s.Update(ctx, operator); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.runningServers()) != 0 {
+		t.Fatal("account server still running without an accountServer section")
+	}
+	if hasFinalizer() {
+		t.Fatal("the finalizer of the stopped account server must be removed")
+	}
+
+	// Accounts of operators without a running server are released, e.g. after a restart
+	current := &natsv1alpha1.NatsAccount{}
+	if err := k8s.Get(ctx, accountReq.NamespacedName, current); err != nil {
+		t.Fatal(err)
+	}
+	controllerutil.AddFinalizer(current, IN_PROCESS_ACCOUNT_SERVER_FINALIZER)
+	if err := k8s.Update(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.reconcileAccount(ctx, accountReq); err != nil {
+		t.Fatal(err)
+	}
+	if hasFinalizer() {
+		t.Fatal("the finalizer must be removed from accounts of operators without an account server")
+	}
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// issueOperator returns an operator with a signing key and the key pairs of both.
+func issueOperator(t *testing.T) (*natsv1alpha1.NatsOperator, nkeys.KeyPair, nkeys.KeyPair) {
+	identity, _ := nkeys.CreateOperator()
+	signingKey, _ := nkeys.CreateOperator()
+	identityPublic, _ := identity.PublicKey()
+	signingPublic, _ := signingKey.PublicKey()
+	claims := jwt.NewOperatorClaims(identityPublic)
+	claims.SigningKeys.Add(signingPublic)
+	token, err := claims.Encode(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Name = "operator"
+	operator.Status.PublicKey = identityPublic
+	operator.Status.JWT = token
+	return operator, identity, signingKey
+}
+
+func issueAccount(t *testing.T, signer nkeys.KeyPair) *natsv1alpha1.NatsAccount {
+	keys, _ := nkeys.CreateAccount()
+	public, _ := keys.PublicKey()
+	token, err := jwt.NewAccountClaims(public).Encode(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &natsv1alpha1.NatsAccount{}
+	account.Name = "account"
+	account.Status.PublicKey = public
+	account.Status.JWT = token
+	return account
+}
+
+func TestValidateIssuer(t *testing.T) {
+	operator, identity, signingKey := issueOperator(t)
+	_, otherIdentity, _ := issueOperator(t)
+
+	if err := validateIssuer(operator, issueAccount(t, identity)); err != nil {
+		t.Errorf("account signed by the identity key: %v", err)
+	}
+	if err := validateIssuer(operator, issueAccount(t, signingKey)); err != nil {
+		t.Errorf("account signed by a signing key: %v", err)
+	}
+	if err := validateIssuer(operator, issueAccount(t, otherIdentity)); err == nil {
+		t.Error("account signed by another operator must be rejected")
+	}
+
+	account := issueAccount(t, identity)
+	account.Status.PublicKey = issueAccount(t, identity).Status.PublicKey
+	if err := validateIssuer(operator, account); err == nil {
+		t.Error("jwt issued for another account must be rejected")
+	}
+}
+
+func TestValidateDeletion(t *testing.T) {
+	operator, identity, signingKey := issueOperator(t)
+	_, otherIdentity, _ := issueOperator(t)
+	account := issueAccount(t, identity)
+
+	deletion := func(signer nkeys.KeyPair, accounts ...interface{}) string {
+		public, _ := signer.PublicKey()
+		claims := jwt.NewGenericClaims(public)
+		claims.Data["accounts"] = accounts
+		token, err := claims.Encode(signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	if keys, err := validateDeletion(operator, deletion(signingKey, account.Status.PublicKey)); err != nil || len(keys) != 1 || keys[0] != account.Status.PublicKey {
+		t.Errorf("deletion signed by a signing key: %v %v", keys, err)
+	}
+	if _, err := validateDeletion(operator, deletion(otherIdentity, account.Status.PublicKey)); err == nil {
+		t.Error("deletion signed by another operator must be rejected")
+	}
+	if _, err := validateDeletion(operator, deletion(identity, "not-a-key")); err == nil {
+		t.Error("malformed deletion must be rejected")
+	}
+}
+
+func TestPushStatus(t *testing.T) {
+	responses := []*nats.Msg{
+		{Data: []byte(`{"server":{"name":"nats-1"},"data":{"code":200,"message":"jwt updated"}}`)},
+		{Data: []byte(`{"server":{"name":"nats-0"},"data":{"code":200,"message":"jwt updated"}}`)},
+		{Data: []byte(`{"server":{"name":"nats-2"},"error":{"code":500,"description":"jwt validation failed"}}`)},
+	}
+	push := pushStatus("jwt", responses)
+	if len(push.AcceptedBy) != 2 || push.AcceptedBy[0] != "nats-0" || push.AcceptedBy[1] != "nats-1" {
+		t.Errorf("unexpected accepting servers %v", push.AcceptedBy)
+	}
+	if len(push.RejectedBy) != 1 || push.RejectedBy[0].Server != "nats-2" || push.RejectedBy[0].Error != "jwt validation failed" {
+		t.Errorf("unexpected rejecting servers %v", push.RejectedBy)
+	}
+	if push.JWTHash != jwtHash("jwt") || push.LastPushed == nil {
+		t.Errorf("unexpected push status %+v", push)
+	}
+}
+
+func TestRecordRepeatedPushFailure(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	_, _, signingKey := issueOperator(t)
+	account := issueAccount(t, signingKey)
+	account.Namespace = "nats"
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(account).Build()
+	r := &NatsAccountServer{Client: k8s, Scheme: scheme}
+	ctx := context.Background()
+	responses := []*nats.Msg{{Data: []byte(`{"server":{"name":"nats-0"},"error":{"code":500,"description":"jwt validation failed"}}`)}}
+	pushErr := fmt.Errorf("rejected by 1 server(s)")
+
+	record := func(push *natsv1alpha1.AccountPushStatus) *natsv1alpha1.NatsAccount {
+		current := &natsv1alpha1.NatsAccount{}
+		if err := k8s.Get(ctx, client.ObjectKeyFromObject(account), current); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.recordPush(ctx, current, push, pushErr); err != nil {
+			t.Fatal(err)
+		}
+		if err := k8s.Get(ctx, client.ObjectKeyFromObject(account), current); err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+	first := record(pushStatus(account.Status.JWT, responses))
+	repeated := pushStatus(account.Status.JWT, responses)
+	repeated.LastPushed = &metav1.Time{Time: repeated.LastPushed.Add(time.Minute)}
+	second := record(repeated)
+	if second.ResourceVersion != first.ResourceVersion {
+		t.Error("a repeated failure must not update the status")
+	}
+	if !second.Status.Push.LastPushed.Equal(first.Status.Push.LastPushed) {
+		t.Errorf("a repeated failure must keep the time of the first push, got %v", second.Status.Push.LastPushed)
+	}
+
+	responses = append(responses, &nats.Msg{Data: []byte(`{"server":{"name":"nats-1"},"data":{"code":200,"message":"jwt updated"}}`)})
+	if third := record(pushStatus(account.Status.JWT, responses)); third.ResourceVersion == second.ResourceVersion || len(third.Status.Push.AcceptedBy) != 1 {
+		t.Errorf("a changed result must be recorded, got %+v", third.Status.Push)
+	}
+}
+
+func TestAccountServerMetrics(t *testing.T) {
+	operator, _, signingKey := issueOperator(t)
+	operator.Namespace = "metrics"
+	account := issueAccount(t, signingKey)
+	account.Namespace = "metrics"
+	scheme := runtime.NewScheme()
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	server := NewAccountServer(client.ObjectKeyFromObject(operator))
+	server.Client = fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator).Build()
+	server.store.Set(server.Operator, client.ObjectKeyFromObject(account), account.Status.PublicKey, account.Status.JWT)
+	server.updateAccountsServed()
+	ctx := context.Background()
+	label := server.Operator.String()
+
+	lookup := server.handleLookup(ctx)
+	lookup(&nats.Msg{Subject: fmt.Sprintf("$SYS.REQ.ACCOUNT.%v.CLAIMS.LOOKUP", account.Status.PublicKey)})
+	lookup(&nats.Msg{Subject: "$SYS.REQ.ACCOUNT.made-up.CLAIMS.LOOKUP"})
+	if hits := testutil.ToFloat64(accountLookups.WithLabelValues(label, account.Status.PublicKey, LOOKUP_RESULT_HIT)); hits != 1 {
+		t.Errorf("expected a hit for the served account, got %v", hits)
+	}
+	if misses := testutil.ToFloat64(accountLookups.WithLabelValues(label, LOOKUP_ACCOUNT_UNKNOWN, LOOKUP_RESULT_MISS)); misses != 1 {
+		t.Errorf("expected a miss for an unknown account, got %v", misses)
+	}
+	if accountLookups.DeleteLabelValues(label, "made-up", LOOKUP_RESULT_MISS) {
+		t.Error("expected misses not to be labeled with the requested account")
+	}
+
+	signingPublic, _ := signingKey.PublicKey()
+	claims := jwt.NewGenericClaims(signingPublic)
+	claims.Data["accounts"] = []string{account.Status.PublicKey}
+	token, err := claims.Encode(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served := testutil.ToFloat64(accountsServed.WithLabelValues(label)); served != 1 {
+		t.Fatalf("expected the account to be served, got %v", served)
+	}
+	server.handleDelete(ctx)(&nats.Msg{Data: []byte(token)})
+	if served := testutil.ToFloat64(accountsServed.WithLabelValues(label)); served != 0 {
+		t.Errorf("expected the deleted account not to be served anymore, got %v", served)
+	}
+}
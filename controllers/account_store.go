@@ -0,0 +1,163 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AccountStore holds the account JWTs served to NATS servers, grouped by the operator that issued them.
+// It is safe for concurrent use.
+type AccountStore struct {
+	lock      sync.RWMutex
+	operators map[client.ObjectKey]*operatorAccounts
+}
+
+type operatorAccounts struct {
+	// jwts maps the public key of an account to its JWT
+	jwts map[string]string
+	// keys maps a NatsAccount to its public key, to drop the JWT of a replaced key
+	keys map[client.ObjectKey]string
+	// deleted maps the public key of an account deleted by a NATS delete request to the JWT it had,
+	// so the same JWT is not served again
+	deleted map[string]string
+}
+
+func NewAccountStore() *AccountStore {
+	return &AccountStore{
+		operators: make(map[client.ObjectKey]*operatorAccounts),
+	}
+}
+
+// Set stores the JWT of an account issued by operator, replacing a previous JWT of the account.
+func (s *AccountStore) Set(operator client.ObjectKey, account client.ObjectKey, publicKey string, jwt string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	accounts, ok := s.operators[operator]
+	if !ok {
+		accounts = &operatorAccounts{
+			jwts:    make(map[string]string),
+			keys:    make(map[client.ObjectKey]string),
+			deleted: make(map[string]string),
+		}
+		s.operators[operator] = accounts
+	}
+	if oldKey, ok := accounts.keys[account]; ok && oldKey != publicKey {
+		delete(accounts.jwts, oldKey)
+	}
+	accounts.keys[account] = publicKey
+	if deletedJWT, ok := accounts.deleted[publicKey]; ok {
+		if deletedJWT == jwt {
+			return
+		}
+		delete(accounts.deleted, publicKey)
+	}
+	accounts.jwts[publicKey] = jwt
+}
+
+// Delete removes the JWT of an account issued by operator.
+func (s *AccountStore) Delete(operator client.ObjectKey, account client.ObjectKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	accounts, ok := s.operators[operator]
+	if !ok {
+		return
+	}
+	if publicKey, ok := accounts.keys[account]; ok {
+		delete(accounts.jwts, publicKey)
+		delete(accounts.deleted, publicKey)
+		delete(accounts.keys, account)
+	}
+	if len(accounts.keys) == 0 {
+		delete(s.operators, operator)
+	}
+}
+
+// Get returns the JWT of the account with the given public key issued by operator.
+func (s *AccountStore) Get(operator client.ObjectKey, publicKey string) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	accounts, ok := s.operators[operator]
+	if !ok {
+		return "", false
+	}
+	jwt, ok := accounts.jwts[publicKey]
+	return jwt, ok
+}
+
+// List returns the JWTs of all accounts issued by operator, keyed by their public key.
+func (s *AccountStore) List(operator client.ObjectKey) map[string]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	accounts, ok := s.operators[operator]
+	if !ok {
+		return map[string]string{}
+	}
+	jwts := make(map[string]string, len(accounts.jwts))
+	for publicKey, jwt := range accounts.jwts {
+		jwts[publicKey] = jwt
+	}
+	return jwts
+}
+
+// DeleteKey stops serving the JWT of the account with the given public key issued by operator, as it has been
+// deleted from the NATS resolvers. The account is served again once it has been issued a new JWT.
+func (s *AccountStore) DeleteKey(operator client.ObjectKey, publicKey string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	accounts, ok := s.operators[operator]
+	if !ok {
+		return
+	}
+	if jwt, ok := accounts.jwts[publicKey]; ok {
+		accounts.deleted[publicKey] = jwt
+		delete(accounts.jwts, publicKey)
+	}
+}
+
+// Hash returns the hash NATS resolvers use to compare their stores, the XOR of the sha256 hashes of all JWTs
+// issued by operator.
+func (s *AccountStore) Hash(operator client.ObjectKey) [sha256.Size]byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	hash := [sha256.Size]byte{}
+	accounts, ok := s.operators[operator]
+	if !ok {
+		return hash
+	}
+	for _, jwt := range accounts.jwts {
+		jwtHash := sha256.Sum256([]byte(jwt))
+		for i := range hash {
+			hash[i] ^= jwtHash[i]
+		}
+	}
+	return hash
+}
+
+// Count returns the number of accounts issued by operator that are served.
+func (s *AccountStore) Count(operator client.ObjectKey) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	accounts, ok := s.operators[operator]
+	if !ok {
+		return 0
+	}
+	return len(accounts.jwts)
+}
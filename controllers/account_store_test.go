@@ -0,0 +1,143 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestAccountStoreScopedByOperator(t *testing.T) {
+	store := NewAccountStore()
+	operatorA := client.ObjectKey{Namespace: "nats", Name: "a"}
+	operatorB := client.ObjectKey{Namespace: "nats", Name: "b"}
+	account := client.ObjectKey{Namespace: "nats", Name: "app"}
+
+	store.Set(operatorA, account, "ACC", "jwt-a")
+	if jwt, ok := store.Get(operatorA, "ACC"); !ok || jwt != "jwt-a" {
+		t.Fatalf("expected jwt-a, got %q (found: %v)", jwt, ok)
+	}
+	if _, ok := store.Get(operatorB, "ACC"); ok {
+		t.Fatal("account must not be served for another operator")
+	}
+
+	store.Delete(operatorB, account)
+	if _, ok := store.Get(operatorA, "ACC"); !ok {
+		t.Fatal("deleting from another operator must not remove the account")
+	}
+	store.Delete(operatorA, account)
+	if _, ok := store.Get(operatorA, "ACC"); ok {
+		t.Fatal("account has not been deleted")
+	}
+}
+
+func TestAccountStoreReplacesKey(t *testing.T) {
+	store := NewAccountStore()
+	operator := client.ObjectKey{Namespace: "nats", Name: "a"}
+	account := client.ObjectKey{Namespace: "nats", Name: "app"}
+
+	store.Set(operator, account, "OLD", "jwt-old")
+	store.Set(operator, account, "NEW", "jwt-new")
+	if _, ok := store.Get(operator, "OLD"); ok {
+		t.Fatal("jwt of the replaced key is still served")
+	}
+	if jwts := store.List(operator); len(jwts) != 1 || jwts["NEW"] != "jwt-new" {
+		t.Fatalf("unexpected accounts %v", jwts)
+	}
+}
+
+func TestAccountStoreConcurrentAccess(t *testing.T) {
+	store := NewAccountStore()
+	operator := client.ObjectKey{Namespace: "nats", Name: "a"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		account := client.ObjectKey{Namespace: "nats", Name: fmt.Sprintf("app-%v", i)}
+		publicKey := fmt.Sprintf("ACC%v", i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				store.Set(operator, account, publicKey, fmt.Sprintf("jwt-%v", j))
+				if j%10 == 0 {
+					store.Delete(operator, account)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				store.Get(operator, publicKey)
+				store.List(operator)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if jwts := store.List(operator); len(jwts) != 8 {
+		t.Fatalf("expected 8 accounts, got %v", len(jwts))
+	}
+}
+
+func TestAccountStoreHash(t *testing.T) {
+	store := NewAccountStore()
+	operator := client.ObjectKey{Namespace: "nats", Name: "a"}
+	empty := store.Hash(operator)
+
+	store.Set(operator, client.ObjectKey{Namespace: "nats", Name: "app"}, "ACC1", "jwt-1")
+	store.Set(operator, client.ObjectKey{Namespace: "nats", Name: "other"}, "ACC2", "jwt-2")
+	hash := store.Hash(operator)
+	if hash == empty {
+		t.Fatal("hash must change with the served accounts")
+	}
+
+	reversed := NewAccountStore()
+	reversed.Set(operator, client.ObjectKey{Namespace: "nats", Name: "other"}, "ACC2", "jwt-2")
+	reversed.Set(operator, client.ObjectKey{Namespace: "nats", Name: "app"}, "ACC1", "jwt-1")
+	if reversed.Hash(operator) != hash {
+		t.Fatal("hash must not depend on the order of the accounts")
+	}
+
+	store.Delete(operator, client.ObjectKey{Namespace: "nats", Name: "app"})
+	store.Delete(operator, client.ObjectKey{Namespace: "nats", Name: "other"})
+	if store.Hash(operator) != empty {
+		t.Fatal("hash of an empty store must be zero")
+	}
+}
+
+func TestAccountStoreDeleteKey(t *testing.T) {
+	store := NewAccountStore()
+	operator := client.ObjectKey{Namespace: "nats", Name: "a"}
+	account := client.ObjectKey{Namespace: "nats", Name: "app"}
+
+	store.Set(operator, account, "ACC", "jwt-1")
+	store.DeleteKey(operator, "ACC")
+	if _, ok := store.Get(operator, "ACC"); ok {
+		t.Fatal("deleted account is still served")
+	}
+	store.Set(operator, account, "ACC", "jwt-1")
+	if _, ok := store.Get(operator, "ACC"); ok {
+		t.Fatal("deleted jwt must not be served again")
+	}
+	store.Set(operator, account, "ACC", "jwt-2")
+	if jwt, ok := store.Get(operator, "ACC"); !ok || jwt != "jwt-2" {
+		t.Fatalf("expected re-issued jwt-2, got %q (found: %v)", jwt, ok)
+	}
+}
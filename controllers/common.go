@@ -1,8 +1,17 @@
 package controllers
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/nats-io/nkeys"
+	"github.com/samber/lo"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 func extractOrCreateKeys(secret *corev1.Secret, generator func() (nkeys.KeyPair, error)) (nkeys.KeyPair, bool, error) {
@@ -25,3 +34,68 @@ func extractOrCreateKeys(secret *corev1.Secret, generator func() (nkeys.KeyPair,
 	}
 	return keys, needsKeyUpdate, nil
 }
+
+// reconcileSigningKeySecret ensures that the secret with the given name contains a key pair for a signing key.
+// It returns the public key of the signing key. An existing secret is only used if it has the type of the signing
+// key secrets and is owned by owner, so other secrets are never taken over.
+func reconcileSigningKeySecret(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, name client.ObjectKey, secretType corev1.SecretType, generator func() (nkeys.KeyPair, error)) (string, error) {
+	keySecret := &corev1.Secret{}
+	hasSecret := true
+	if err := c.Get(ctx, name, keySecret); errors.IsNotFound(err) {
+		keySecret.Namespace = name.Namespace
+		keySecret.Name = name.Name
+		keySecret.Type = secretType
+		hasSecret = false
+		if err := controllerutil.SetOwnerReference(owner, keySecret, scheme); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	} else if keySecret.Type != secretType || !lo.ContainsBy(keySecret.OwnerReferences, func(ref metav1.OwnerReference) bool { return ref.UID == owner.GetUID() }) {
+		return "", fmt.Errorf("secret %v exists already and is not a %v secret of %v, refusing to adopt it", name.Name, secretType, owner.GetName())
+	}
+
+	keys, needsKeyUpdate, err := extractOrCreateKeys(keySecret, generator)
+	if err != nil {
+		return "", err
+	}
+	seed, _ := keys.Seed()
+	public, _ := keys.PublicKey()
+	if needsKeyUpdate {
+		keySecret.Data = map[string][]byte{
+			OPERATOR_SEED_KEY:   seed,
+			OPERATOR_PUBLIC_KEY: []byte(public),
+		}
+	}
+
+	if !hasSecret {
+		if err := c.Create(ctx, keySecret); err != nil {
+			return "", err
+		}
+	} else if needsKeyUpdate {
+		if err := c.Update(ctx, keySecret); err != nil {
+			return "", err
+		}
+	}
+	return public, nil
+}
+
+// signingKeySecretName returns the name of the secret of a signing key, prefixed with the kind of the owner so the
+// secrets of operators and accounts don't collide. Keys generated before keep the secret listed in the status.
+func signingKeySecretName(owner client.Object, kind string, name string, previous string) client.ObjectKey {
+	if previous == "" {
+		previous = fmt.Sprintf("%v-%v-sk-%v", owner.GetName(), kind, name)
+	}
+	return client.ObjectKey{Namespace: owner.GetNamespace(), Name: previous}
+}
+
+// deleteSecret removes a secret, a secret that's already gone is not an error.
+func deleteSecret(ctx context.Context, c client.Client, name client.ObjectKey) error {
+	secret := &corev1.Secret{}
+	secret.Namespace = name.Namespace
+	secret.Name = name.Name
+	if err := c.Delete(ctx, secret); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestSigningKeySecretName(t *testing.T) {
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Namespace = "nats"
+	operator.Name = "shared"
+	account := &natsv1alpha1.NatsAccount{}
+	account.Namespace = "nats"
+	account.Name = "shared"
+	if signingKeySecretName(operator, "operator", "key", "") == signingKeySecretName(account, "account", "key", "") {
+		t.Error("signing key secrets of operators and accounts must not collide")
+	}
+	if name := signingKeySecretName(account, "account", "key", "shared-sk-key"); name.Name != "shared-sk-key" || name.Namespace != "nats" {
+		t.Errorf("expected the previous secret to be kept, got %v", name)
+	}
+}
+
+func TestReconcileSigningKeySecret(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Namespace = "nats"
+	operator.Name = "operator"
+	operator.UID = "operator-uid"
+	foreign := &corev1.Secret{}
+	foreign.Namespace = "nats"
+	foreign.Name = "foreign"
+	foreign.Type = corev1.SecretTypeOpaque
+	otherOwner := &corev1.Secret{}
+	otherOwner.Namespace = "nats"
+	otherOwner.Name = "other-owner"
+	otherOwner.Type = "deinstapel.de/nats-operator-signing-key"
+	otherOwner.OwnerReferences = []metav1.OwnerReference{{APIVersion: "nats.deinstapel.de/v1alpha1", Kind: "NatsOperator", Name: "other", UID: "other-uid"}}
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(foreign, otherOwner).Build()
+	ctx := context.Background()
+	reconcile := func(name string) (string, error) {
+		return reconcileSigningKeySecret(ctx, k8s, scheme, operator, client.ObjectKey{Namespace: "nats", Name: name}, "deinstapel.de/nats-operator-signing-key", nkeys.CreateOperator)
+	}
+
+	public, err := reconcile("operator-operator-sk-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused, err := reconcile("operator-operator-sk-key"); err != nil || reused != public {
+		t.Errorf("expected the key pair of the owned secret to be reused, got %v, %v", reused, err)
+	}
+	for _, name := range []string{"foreign", "other-owner"} {
+		if _, err := reconcile(name); err == nil {
+			t.Errorf("secret %v must not be adopted", name)
+		}
+	}
+	if err := k8s.Get(ctx, client.ObjectKeyFromObject(foreign), foreign); err != nil || len(foreign.Data) != 0 {
+		t.Errorf("secret foreign must be left untouched, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"regexp"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// seedPattern matches encoded nkey seeds of all key types.
+var seedPattern = regexp.MustCompile(`S[OACNUPX][A-Z2-7]{56}`)
+
+// errorMessage returns the message of err for conditions and events, errors may wrap secret data so any
+// nkey seeds are redacted.
+func errorMessage(err error) string {
+	return seedPattern.ReplaceAllString(err.Error(), "[redacted]")
+}
+
+// setCondition sets a condition in the status of obj, the observed generation is taken from obj.
+func setCondition(conditions *[]metav1.Condition, obj client.Object, conditionType string, status bool, reason string, message string) {
+	conditionStatus := metav1.ConditionFalse
+	if status {
+		conditionStatus = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: obj.GetGeneration(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setReadyCondition sets the ready condition after reconciling obj. Errors take precedence, if obj is
+// neither ready nor failed the reconciler has already set the ready condition to the reason it's waiting for.
+func setReadyCondition(conditions *[]metav1.Condition, obj client.Object, ready bool, err error) {
+	if errors.IsConflict(err) {
+		// We're working on an outdated object, the next reconcile will tell.
+		return
+	}
+	if err != nil {
+		setCondition(conditions, obj, natsv1alpha1.CONDITION_READY, false, "ReconcileFailed", errorMessage(err))
+	} else if ready {
+		setCondition(conditions, obj, natsv1alpha1.CONDITION_READY, true, "Reconciled", "")
+	}
+}
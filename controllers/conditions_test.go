@@ -0,0 +1,40 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestErrorMessage(t *testing.T) {
+	for _, create := range []func() (nkeys.KeyPair, error){nkeys.CreateOperator, nkeys.CreateAccount, nkeys.CreateUser} {
+		keys, _ := create()
+		seed, _ := keys.Seed()
+		public, _ := keys.PublicKey()
+		message := errorMessage(fmt.Errorf("failed decoding %v of %v", string(seed), public))
+		if strings.Contains(message, string(seed)) {
+			t.Errorf("expected the seed to be redacted, got %v", message)
+		}
+		if !strings.Contains(message, public) {
+			t.Errorf("expected public keys to be kept, got %v", message)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// recordIssued posts the events for a (re-)issued JWT of obj. changes contains the claim fields that differ
+// from the previous JWT, it is empty if there was no previous JWT.
+func recordIssued(recorder record.EventRecorder, obj runtime.Object, publicKey string, keysGenerated bool, changes []string) {
+	if keysGenerated {
+		recorder.Eventf(obj, corev1.EventTypeNormal, "KeysGenerated", "Generated key pair %v", publicKey)
+	}
+	if len(changes) == 0 {
+		recorder.Event(obj, corev1.EventTypeNormal, "Issued", "Issued JWT")
+		return
+	}
+	recorder.Eventf(obj, corev1.EventTypeNormal, "Reissued", "Re-issued JWT, changed: %v", strings.Join(changes, ", "))
+}
+
+// changedFields returns the JSON names of the fields that differ between the claims a and b of the same type.
+// Embedded structs without a JSON name are compared field by field.
+func changedFields(a interface{}, b interface{}) []string {
+	var changes []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			changes = append(changes, changedFields(va.Field(i).Interface(), vb.Field(i).Interface())...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changes = append(changes, name)
+		}
+	}
+	return changes
+}
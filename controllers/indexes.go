@@ -0,0 +1,107 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Field indexes used to find the dependents of an object, the values are formatted as $NAMESPACE/$NAME
+const ACCOUNT_REF_INDEX = "spec.accountRef"
+const OPERATOR_REF_INDEX = "spec.operatorRef"
+const OFFLINE_ROOT_INDEX = "spec.offlineRoot.secretName"
+const CONFIG_TEMPLATE_INDEX = "spec.configTemplate.configMapName"
+
+// SetupFieldIndexes registers the field indexes needed by the controllers with the manager.
+func SetupFieldIndexes(ctx context.Context, mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &natsv1alpha1.NatsUser{}, ACCOUNT_REF_INDEX, accountRefIndex); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &natsv1alpha1.NatsAccount{}, OPERATOR_REF_INDEX, operatorRefIndex); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &natsv1alpha1.NatsOperator{}, OFFLINE_ROOT_INDEX, offlineRootIndex); err != nil {
+		return err
+	}
+	return mgr.GetFieldIndexer().IndexField(ctx, &natsv1alpha1.NatsOperator{}, CONFIG_TEMPLATE_INDEX, configTemplateIndex)
+}
+
+// SetupAccountServerFieldIndexes registers the field indexes needed by the standalone account server with the manager.
+func SetupAccountServerFieldIndexes(ctx context.Context, mgr ctrl.Manager) error {
+	return mgr.GetFieldIndexer().IndexField(ctx, &natsv1alpha1.NatsAccount{}, OPERATOR_REF_INDEX, operatorRefIndex)
+}
+
+// accountRefIndex indexes users by the account issuing them.
+func accountRefIndex(obj client.Object) []string {
+	return []string{indexKey(accountRef(obj.(*natsv1alpha1.NatsUser)))}
+}
+
+// operatorRefIndex indexes accounts by the operator issuing them.
+func operatorRefIndex(obj client.Object) []string {
+	return []string{indexKey(operatorRef(obj.(*natsv1alpha1.NatsAccount)))}
+}
+
+// offlineRootIndex indexes operators by the secret of their offline root, as the secret isn't owned by them.
+func offlineRootIndex(obj client.Object) []string {
+	operator := obj.(*natsv1alpha1.NatsOperator)
+	if operator.Spec.OfflineRoot == nil {
+		return nil
+	}
+	return []string{indexKey(client.ObjectKey{Namespace: operator.Namespace, Name: operator.Spec.OfflineRoot.SecretName})}
+}
+
+// configTemplateIndex indexes operators by the ConfigMap of their server configuration template.
+func configTemplateIndex(obj client.Object) []string {
+	operator := obj.(*natsv1alpha1.NatsOperator)
+	if operator.Spec.ConfigTemplate == nil {
+		return nil
+	}
+	return []string{indexKey(client.ObjectKey{Namespace: operator.Namespace, Name: operator.Spec.ConfigTemplate.ConfigMapName})}
+}
+
+func indexKey(key client.ObjectKey) string {
+	return fmt.Sprintf("%v/%v", key.Namespace, key.Name)
+}
+
+// accountRef returns the key of the account issuing the user, defaulting to the namespace of the user.
+func accountRef(user *natsv1alpha1.NatsUser) client.ObjectKey {
+	namespace := user.Spec.AccountRef.Namespace
+	if namespace == "" {
+		namespace = user.Namespace
+	}
+	return client.ObjectKey{Namespace: namespace, Name: user.Spec.AccountRef.Name}
+}
+
+// operatorRef returns the key of the operator issuing the account, which always lives in the namespace of the account.
+func operatorRef(account *natsv1alpha1.NatsAccount) client.ObjectKey {
+	return client.ObjectKey{Namespace: account.Namespace, Name: account.Spec.OperatorRef.Name}
+}
+
+// systemAccountName returns the key of the system account created for the operator.
+func systemAccountName(operator client.ObjectKey) client.ObjectKey {
+	return client.ObjectKey{Namespace: operator.Namespace, Name: fmt.Sprintf("%v-system", operator.Name)}
+}
+
+// isSystemAccount reports whether the account is the system account of its operator.
+func isSystemAccount(account *natsv1alpha1.NatsAccount) bool {
+	return client.ObjectKeyFromObject(account) == systemAccountName(operatorRef(account))
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func newUser(namespace, name, accountNamespace, accountName string) *natsv1alpha1.NatsUser {
+	user := &natsv1alpha1.NatsUser{}
+	user.Namespace = namespace
+	user.Name = name
+	user.Spec.AccountRef.Namespace = accountNamespace
+	user.Spec.AccountRef.Name = accountName
+	return user
+}
+
+func newAccount(namespace, name, operatorNamespace, operatorName string) *natsv1alpha1.NatsAccount {
+	account := &natsv1alpha1.NatsAccount{}
+	account.Namespace = namespace
+	account.Name = name
+	account.Spec.OperatorRef.Namespace = operatorNamespace
+	account.Spec.OperatorRef.Name = operatorName
+	return account
+}
+
+func requestKeys(requests []reconcile.Request) []string {
+	keys := lo.Map(requests, func(req reconcile.Request, _ int) string { return indexKey(req.NamespacedName) })
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRefs(t *testing.T) {
+	if ref := accountRef(newUser("apps", "user", "", "account")); ref != (client.ObjectKey{Namespace: "apps", Name: "account"}) {
+		t.Errorf("expected the account namespace to default to the namespace of the user, got %v", ref)
+	}
+	if ref := accountRef(newUser("apps", "user", "nats", "account")); ref != (client.ObjectKey{Namespace: "nats", Name: "account"}) {
+		t.Errorf("expected the namespace of the account reference, got %v", ref)
+	}
+	// Operators always live in the namespace of their accounts
+	if ref := operatorRef(newAccount("nats", "account", "other", "operator")); ref != (client.ObjectKey{Namespace: "nats", Name: "operator"}) {
+		t.Errorf("expected the operator in the namespace of the account, got %v", ref)
+	}
+
+	operator := client.ObjectKey{Namespace: "nats", Name: "operator"}
+	if name := systemAccountName(operator); name != (client.ObjectKey{Namespace: "nats", Name: "operator-system"}) {
+		t.Errorf("expected the system account operator-system, got %v", name)
+	}
+	for _, test := range []struct {
+		account  *natsv1alpha1.NatsAccount
+		expected bool
+	}{
+		{newAccount("nats", "operator-system", "", "operator"), true},
+		{newAccount("nats", "account", "", "operator"), false},
+		{newAccount("nats", "operator-system", "", "other"), false},
+	} {
+		if isSystemAccount(test.account) != test.expected {
+			t.Errorf("expected isSystemAccount of %v issued by %v to be %v", test.account.Name, test.account.Spec.OperatorRef.Name, test.expected)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	if keys := accountRefIndex(newUser("apps", "user", "", "account")); !reflect.DeepEqual(keys, []string{"apps/account"}) {
+		t.Errorf("expected users to be indexed by their account, got %v", keys)
+	}
+	if keys := operatorRefIndex(newAccount("nats", "account", "", "operator")); !reflect.DeepEqual(keys, []string{"nats/operator"}) {
+		t.Errorf("expected accounts to be indexed by their operator, got %v", keys)
+	}
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Namespace = "nats"
+	if keys := offlineRootIndex(operator); keys != nil {
+		t.Errorf("expected operators without an offline root not to be indexed, got %v", keys)
+	}
+	operator.Spec.OfflineRoot = &natsv1alpha1.OfflineRoot{SecretName: "root"}
+	if keys := offlineRootIndex(operator); !reflect.DeepEqual(keys, []string{"nats/root"}) {
+		t.Errorf("expected operators to be indexed by their offline root secret, got %v", keys)
+	}
+	if keys := configTemplateIndex(operator); keys != nil {
+		t.Errorf("expected operators without a config template not to be indexed, got %v", keys)
+	}
+	operator.Spec.ConfigTemplate = &natsv1alpha1.ConfigTemplate{ConfigMapName: "template"}
+	if keys := configTemplateIndex(operator); !reflect.DeepEqual(keys, []string{"nats/template"}) {
+		t.Errorf("expected operators to be indexed by their config template, got %v", keys)
+	}
+}
+
+func TestFindDependents(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	templated := &natsv1alpha1.NatsOperator{}
+	templated.Namespace = "nats"
+	templated.Name = "templated"
+	templated.Spec.ConfigTemplate = &natsv1alpha1.ConfigTemplate{ConfigMapName: "template"}
+	// The ConfigMap of the same name in its own namespace
+	otherNamespace := templated.DeepCopy()
+	otherNamespace.Namespace = "apps"
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		templated,
+		otherNamespace,
+		newUser("apps", "explicit", "nats", "account"),
+		newUser("nats", "defaulted", "", "account"),
+		// Issued by the account of the same name in its own namespace
+		newUser("apps", "local", "", "account"),
+		newUser("nats", "other", "", "other"),
+		newAccount("nats", "account", "", "operator"),
+		newAccount("nats", "other", "", "other"),
+		// Issued by the operator of the same name in its own namespace
+		newAccount("apps", "account", "nats", "operator"),
+	).
+		WithIndex(&natsv1alpha1.NatsUser{}, ACCOUNT_REF_INDEX, accountRefIndex).
+		WithIndex(&natsv1alpha1.NatsAccount{}, OPERATOR_REF_INDEX, operatorRefIndex).
+		WithIndex(&natsv1alpha1.NatsOperator{}, CONFIG_TEMPLATE_INDEX, configTemplateIndex).Build()
+
+	users := (&NatsUserReconciler{Client: k8s}).findIssuedUsers(newAccount("nats", "account", "", "operator"))
+	if keys := requestKeys(users); !reflect.DeepEqual(keys, []string{"apps/explicit", "nats/defaulted"}) {
+		t.Errorf("expected the users issued by nats/account, got %v", keys)
+	}
+
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Namespace = "nats"
+	operator.Name = "operator"
+	accounts := (&AccountServerRunner{Client: k8s}).findOperatorAccounts(operator)
+	if keys := requestKeys(accounts); !reflect.DeepEqual(keys, []string{"nats/account"}) {
+		t.Errorf("expected the accounts issued by nats/operator, got %v", keys)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	configMap.Namespace = "nats"
+	configMap.Name = "template"
+	templatedOperators := (&NatsOperatorReconciler{Client: k8s}).findTemplatedOperators(configMap)
+	if keys := requestKeys(templatedOperators); !reflect.DeepEqual(keys, []string{"nats/templated"}) {
+		t.Errorf("expected the operators templated by nats/template, got %v", keys)
+	}
+}
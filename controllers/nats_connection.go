@@ -0,0 +1,126 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// NatsConnection configures how the account server connects to NATS.
+type NatsConnection struct {
+	// URLs are the seed URLs of the NATS cluster
+	URLs []string `json:"urls,omitempty"`
+	// Name is the name of the connection, defaults to ACCOUNT_SERVER_NAME
+	Name string `json:"name,omitempty"`
+	// CredsFile is the path of a user credentials file
+	CredsFile string `json:"credsFile,omitempty"`
+	// Creds are user credentials, an alternative to CredsFile used by the account servers inside the operator
+	Creds []byte `json:"-"`
+	// NKeySeedFile is the path of a file with a user nkey seed, an alternative to CredsFile
+	NKeySeedFile string `json:"nkeySeedFile,omitempty"`
+	// TLSCAFile is the path of the CA certificates used to verify the NATS servers
+	TLSCAFile string `json:"tlsCAFile,omitempty"`
+	// TLSCertFile and TLSKeyFile are the paths of the client certificate and its key
+	TLSCertFile string `json:"tlsCertFile,omitempty"`
+	TLSKeyFile  string `json:"tlsKeyFile,omitempty"`
+}
+
+// Validate checks that the URLs are valid, the referenced files exist and the options can be combined.
+func (c *NatsConnection) Validate() error {
+	if len(c.URLs) == 0 {
+		return fmt.Errorf("at least one NATS URL is required")
+	}
+	for _, rawURL := range c.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("invalid NATS URL %q: %v", rawURL, err)
+		}
+		switch u.Scheme {
+		case "nats", "tls", "ws", "wss":
+		default:
+			return fmt.Errorf("invalid NATS URL %q: the scheme must be nats, tls, ws or wss", rawURL)
+		}
+	}
+	if (c.CredsFile != "" || len(c.Creds) > 0) && c.NKeySeedFile != "" {
+		return fmt.Errorf("user credentials and a nkey seed can't be used together")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("the TLS client certificate requires both the certificate and the key")
+	}
+	for _, file := range []string{c.CredsFile, c.NKeySeedFile, c.TLSCAFile, c.TLSCertFile, c.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Options returns the NATS options for the authentication and TLS settings of the connection.
+func (c *NatsConnection) Options() ([]nats.Option, error) {
+	name := c.Name
+	if name == "" {
+		name = ACCOUNT_SERVER_NAME
+	}
+	options := []nats.Option{nats.Name(name)}
+	if c.CredsFile != "" {
+		options = append(options, nats.UserCredentials(c.CredsFile))
+	}
+	if len(c.Creds) > 0 {
+		userJWT, err := jwt.ParseDecoratedJWT(c.Creds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user credentials: %v", err)
+		}
+		keyPair, err := nkeys.ParseDecoratedNKey(c.Creds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user credentials: %v", err)
+		}
+		seed, err := keyPair.Seed()
+		if err != nil {
+			return nil, fmt.Errorf("invalid user credentials: %v", err)
+		}
+		options = append(options, nats.UserJWTAndSeed(userJWT, string(seed)))
+	}
+	if c.NKeySeedFile != "" {
+		option, err := nats.NkeyOptionFromSeed(c.NKeySeedFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+	}
+	if c.TLSCAFile != "" {
+		options = append(options, nats.RootCAs(c.TLSCAFile))
+	}
+	if c.TLSCertFile != "" {
+		options = append(options, nats.ClientCert(c.TLSCertFile, c.TLSKeyFile))
+	}
+	return options, nil
+}
+
+// Servers returns the URLs joined the way nats.Connect expects them.
+func (c *NatsConnection) Servers() string {
+	return strings.Join(c.URLs, ",")
+}
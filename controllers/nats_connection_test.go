@@ -0,0 +1,59 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNatsConnectionValidate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, []byte("content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	urls := []string{"nats://nats-0:4222", "tls://nats-1:4222", "ws://nats-2:8080", "wss://nats-3:443"}
+	for _, tc := range []struct {
+		name       string
+		connection NatsConnection
+		valid      bool
+	}{
+		{name: "urls only", connection: NatsConnection{URLs: urls}, valid: true},
+		{name: "credentials file", connection: NatsConnection{URLs: urls, CredsFile: file}, valid: true},
+		{name: "inline credentials", connection: NatsConnection{URLs: urls, Creds: []byte("creds")}, valid: true},
+		{name: "nkey seed", connection: NatsConnection{URLs: urls, NKeySeedFile: file}, valid: true},
+		{name: "tls", connection: NatsConnection{URLs: urls, TLSCAFile: file, TLSCertFile: file, TLSKeyFile: file}, valid: true},
+		{name: "no urls", connection: NatsConnection{}},
+		{name: "invalid url", connection: NatsConnection{URLs: []string{"nats://nats:port"}}},
+		{name: "unsupported scheme", connection: NatsConnection{URLs: []string{"http://nats:4222"}}},
+		{name: "credentials and nkey seed", connection: NatsConnection{URLs: urls, CredsFile: file, NKeySeedFile: file}},
+		{name: "inline credentials and nkey seed", connection: NatsConnection{URLs: urls, Creds: []byte("creds"), NKeySeedFile: file}},
+		{name: "certificate without key", connection: NatsConnection{URLs: urls, TLSCertFile: file}},
+		{name: "key without certificate", connection: NatsConnection{URLs: urls, TLSKeyFile: file}},
+		{name: "missing file", connection: NatsConnection{URLs: urls, TLSCAFile: missing}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.connection.Validate(); tc.valid && err != nil {
+				t.Errorf("expected a valid connection, got %v", err)
+			} else if !tc.valid && err == nil {
+				t.Error("expected the connection to be rejected")
+			}
+		})
+	}
+}
@@ -24,26 +24,47 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nkeys"
+	"github.com/samber/lo"
 )
 
 // NatsAccountReconciler reconciles a NatsAccount object
 type NatsAccountReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// MaxConcurrentReconciles is the number of accounts reconciled in parallel, defaults to 1
+	MaxConcurrentReconciles int
+	// AccountServers is set if account servers run inside the operator, otherwise the finalizer of a previous
+	// run with account servers is removed from the accounts
+	AccountServers bool
+	// DeletionTimeout is the time a deleted account waits for the account servers to delete it from the resolvers
+	// before their finalizers are removed, defaults to ACCOUNT_SERVER_DELETION_TIMEOUT
+	DeletionTimeout time.Duration
 }
 
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsaccounts/finalizers,verbs=update
+//+kubebuilder:rbac:groups=,resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -64,16 +85,35 @@ func (r *NatsAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		}
 		return ctrl.Result{}, err
 	}
+	if !r.AccountServers {
+		if err := releaseAccount(ctx, r.Client, account); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
 	if account.DeletionTimestamp != nil {
-		// TODO: Check if deletion is ok.
 		logger.Info("Processing deletion of account")
+		if controllerutil.ContainsFinalizer(account, JWT_OPERATOR_FINALIZER) && account.Status.PublicKey != "" && account.Status.DeletionJWT == "" && !isSystemAccount(account) {
+			// The account server removes the account from the resolvers with this request
+			deletionJWT, err := r.issueDeletion(ctx, account)
+			if errors.IsNotFound(err) {
+				logger.Info("operator or its signing key is gone, can't delete the account from the resolvers")
+				r.Recorder.Eventf(account, corev1.EventTypeWarning, "SignerNotFound", "Can't issue the deletion of the account: %v", errorMessage(err))
+			} else if err != nil {
+				return ctrl.Result{}, err
+			} else {
+				account.Status.DeletionJWT = deletionJWT
+				if err := r.Status().Update(ctx, account); err != nil {
+					return ctrl.Result{}, err
+				}
+			}
+		}
 		if controllerutil.RemoveFinalizer(account, JWT_OPERATOR_FINALIZER) {
 			if err := r.Update(ctx, account); err != nil {
 				return ctrl.Result{}, err
 			}
 		}
-		return ctrl.Result{}, nil
+		return r.releaseDeletion(ctx, account)
 	}
 
 	if controllerutil.AddFinalizer(account, JWT_OPERATOR_FINALIZER) {
@@ -82,37 +122,141 @@ func (r *NatsAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		}
 	}
 
+	status := account.Status.DeepCopy()
+	ready, err := r.reconcileAccount(ctx, req, account)
+	setReadyCondition(&account.Status.Conditions, account, ready, err)
+	account.Status.ObservedGeneration = account.Generation
+	if !reflect.DeepEqual(status, &account.Status) {
+		if updateErr := r.Status().Update(ctx, account); updateErr != nil && err == nil {
+			err = updateErr
+		}
+	}
+	return ctrl.Result{}, err
+}
+
+// reconcileAccount issues the account, the results are written to the status of the account.
+// It returns whether the account is ready.
+// releaseDeletion removes the finalizers of the account servers from a deleted account once they didn't delete it
+// from the resolvers in time, so the account isn't kept forever if no account server is running or it can't reach
+// NATS. Until then the account is requeued.
+func (r *NatsAccountReconciler) releaseDeletion(ctx context.Context, account *natsv1alpha1.NatsAccount) (ctrl.Result, error) {
+	finalizers := []string{ACCOUNT_SERVER_FINALIZER, IN_PROCESS_ACCOUNT_SERVER_FINALIZER}
+	if !lo.Some(account.Finalizers, finalizers) {
+		return ctrl.Result{}, nil
+	}
+	timeout := r.DeletionTimeout
+	if timeout == 0 {
+		timeout = ACCOUNT_SERVER_DELETION_TIMEOUT
+	}
+	if wait := time.Until(account.DeletionTimestamp.Add(timeout)); wait > 0 {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+	log.FromContext(ctx).Info("account servers did not delete the account from the resolvers in time, releasing it")
+	r.Recorder.Eventf(account, corev1.EventTypeWarning, "DeletionTimeout", "No account server deleted the account from the resolvers within %v, it is kept by the resolvers", timeout)
+	for _, finalizer := range finalizers {
+		controllerutil.RemoveFinalizer(account, finalizer)
+	}
+	return ctrl.Result{}, client.IgnoreNotFound(r.Update(ctx, account))
+}
+
+func (r *NatsAccountReconciler) reconcileAccount(ctx context.Context, req ctrl.Request, account *natsv1alpha1.NatsAccount) (bool, error) {
+	logger := log.FromContext(ctx)
 	issuer := &natsv1alpha1.NatsOperator{}
 	signerSecret := &corev1.Secret{}
-	for {
-		if err := r.Get(ctx, client.ObjectKey{
-			Namespace: req.Namespace,
-			Name:      account.Spec.OperatorRef.Name,
-		}, issuer); err != nil {
-			// TODO: post event to apiserver
-			return ctrl.Result{}, err
-		}
-		if issuer.Status.OperatorSecretName == "" {
-			logger.Info("waiting for issuing account secret to appear")
-			<-time.After(5 * time.Second)
-			continue
+	if err := r.Get(ctx, operatorRef(account), issuer); err != nil {
+		if errors.IsNotFound(err) {
+			r.Recorder.Eventf(account, corev1.EventTypeWarning, "OperatorNotFound", "Operator %v does not exist", account.Spec.OperatorRef.Name)
 		}
+		return false, err
+	}
+	if issuer.Status.SignerSecretName == "" {
+		// The operator watch enqueues this account once the signer is known
+		logger.Info("waiting for issuing operator secret to appear")
+		message := fmt.Sprintf("waiting for operator %v to be issued", issuer.Name)
+		setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_JWT_ISSUED, false, "WaitingForOperator", message)
+		setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_READY, false, "WaitingForOperator", message)
+		return false, nil
+	}
+	if err := r.Get(ctx, client.ObjectKey{
+		Namespace: issuer.Namespace,
+		Name:      issuer.Status.SignerSecretName,
+	}, signerSecret); err != nil {
+		r.Recorder.Eventf(account, corev1.EventTypeWarning, "SignerNotFound", "Failed to get signing key %v of operator %v: %v", issuer.Status.SignerSecretName, issuer.Name, errorMessage(err))
+		return false, err
+	}
+	logger.Info("issuing operator secret found")
 
-		if err := r.Get(ctx, client.ObjectKey{
-			Namespace: issuer.Namespace,
-			Name:      issuer.Status.OperatorSecretName,
-		}, signerSecret); err != nil {
-			return ctrl.Result{}, err
+	signingKeys, err := r.reconcileSigningKeys(ctx, account)
+	if err != nil {
+		r.Recorder.Eventf(account, corev1.EventTypeWarning, "SigningKeysFailed", "Failed to reconcile signing keys: %v", errorMessage(err))
+		setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_KEYS_READY, false, "SigningKeysFailed", errorMessage(err))
+		return false, err
+	}
+
+	if _, err := r.reconcileSecret(ctx, req, account, signerSecret, signingKeys); err != nil {
+		return false, err
+	}
+	setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_KEYS_READY, true, "KeysGenerated", "")
+	setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_JWT_ISSUED, true, "Issued", fmt.Sprintf("signed by %v", issuer.Status.SignerPublicKey))
+	return true, nil
+}
+
+// issueDeletion signs the request to delete the account from the NATS resolvers with the signer of the operator.
+// NATS servers only accept deletions that are self signed by the operator or one of its signing keys.
+func (r *NatsAccountReconciler) issueDeletion(ctx context.Context, account *natsv1alpha1.NatsAccount) (string, error) {
+	issuer := &natsv1alpha1.NatsOperator{}
+	if err := r.Get(ctx, operatorRef(account), issuer); err != nil {
+		return "", err
+	}
+	signerSecret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{
+		Namespace: issuer.Namespace,
+		Name:      issuer.Status.SignerSecretName,
+	}, signerSecret); err != nil {
+		return "", err
+	}
+	signerKp, err := nkeys.FromSeed(signerSecret.Data[OPERATOR_SEED_KEY])
+	if err != nil {
+		return "", fmt.Errorf("failed decoding seed: %v", err)
+	}
+	signerPublic, _ := signerKp.PublicKey()
+	claims := jwt.NewGenericClaims(signerPublic)
+	claims.Data["accounts"] = []string{account.Status.PublicKey}
+	return claims.Encode(signerKp)
+}
+
+// reconcileSigningKeys ensures a secret with a key pair exists for every signing key of the account
+// and removes the secrets of signing keys that have been dropped from the spec.
+func (r *NatsAccountReconciler) reconcileSigningKeys(ctx context.Context, account *natsv1alpha1.NatsAccount) ([]natsv1alpha1.AccountSigningKeyStatus, error) {
+	logger := log.FromContext(ctx)
+	var signingKeys []natsv1alpha1.AccountSigningKeyStatus
+	for _, key := range account.Spec.SigningKeys {
+		previous, _ := lo.Find(account.Status.SigningKeys, func(k natsv1alpha1.AccountSigningKeyStatus) bool { return k.Role == key.Role })
+		keySecretName := signingKeySecretName(account, "account", key.Role, previous.SecretName)
+		public, err := reconcileSigningKeySecret(ctx, r.Client, r.Scheme, account, keySecretName, "deinstapel.de/nats-account-signing-key", nkeys.CreateAccount)
+		if err != nil {
+			return nil, err
 		}
-		logger.Info("issuing account secret found")
-		break
+		signingKeys = append(signingKeys, natsv1alpha1.AccountSigningKeyStatus{
+			Role:       key.Role,
+			SecretName: keySecretName.Name,
+			PublicKey:  public,
+		})
 	}
 
-	_, err := r.reconcileSecret(ctx, req, account, signerSecret)
-	return ctrl.Result{}, err
+	for _, key := range account.Status.SigningKeys {
+		if lo.ContainsBy(signingKeys, func(k natsv1alpha1.AccountSigningKeyStatus) bool { return k.SecretName == key.SecretName }) {
+			continue
+		}
+		logger.Info("removing account signing key", "role", key.Role)
+		if err := deleteSecret(ctx, r.Client, client.ObjectKey{Namespace: account.Namespace, Name: key.SecretName}); err != nil {
+			return nil, err
+		}
+	}
+	return signingKeys, nil
 }
 
-func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, account *natsv1alpha1.NatsAccount, signerSecret *corev1.Secret) (*corev1.Secret, error) {
+func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, account *natsv1alpha1.NatsAccount, signerSecret *corev1.Secret, signingKeys []natsv1alpha1.AccountSigningKeyStatus) (*corev1.Secret, error) {
 	// Try reconcile the secret containing the seed key for the operator
 	logger := log.FromContext(ctx)
 	keySecret := &corev1.Secret{}
@@ -131,7 +275,7 @@ func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Re
 	}
 
 	logger.Info("reconciling account keys")
-	hasChanges, err := r.reconcileKey(ctx, keySecret, account, signerSecret.Data[OPERATOR_SEED_KEY])
+	hasChanges, err := r.reconcileKey(ctx, keySecret, account, signerSecret.Data[OPERATOR_SEED_KEY], signingKeys)
 	if err != nil {
 		return nil, err
 	}
@@ -147,18 +291,20 @@ func (r *NatsAccountReconciler) reconcileSecret(ctx context.Context, req ctrl.Re
 	}
 
 	if !hasSecret || hasChanges {
-		// Update operator status if we encountered changes
-		account.Status.AccountSecretName = keySecret.Name
-		account.Status.PublicKey = string(keySecret.Data[OPERATOR_PUBLIC_KEY])
-		account.Status.JWT = string(keySecret.Data[OPERATOR_JWT])
-		if err := r.Status().Update(ctx, account); err != nil {
-			return nil, err
+		account.Status.LastIssued = &metav1.Time{Time: time.Now()}
+		if meta.FindStatusCondition(account.Status.Conditions, natsv1alpha1.CONDITION_PUSHED) != nil {
+			// An account server is pushing this account, the new JWT is pending until it did so
+			setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_PUSHED, false, "Pending", "account has been re-issued")
 		}
 	}
+	account.Status.AccountSecretName = keySecret.Name
+	account.Status.PublicKey = string(keySecret.Data[OPERATOR_PUBLIC_KEY])
+	account.Status.JWT = string(keySecret.Data[OPERATOR_JWT])
+	account.Status.SigningKeys = signingKeys
 	return keySecret, nil
 }
 
-func (r *NatsAccountReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, account *natsv1alpha1.NatsAccount, signer []byte) (bool, error) {
+func (r *NatsAccountReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, account *natsv1alpha1.NatsAccount, signer []byte, signingKeys []natsv1alpha1.AccountSigningKeyStatus) (bool, error) {
 	logger := log.FromContext(ctx)
 	keys, needsKeyUpdate, err := extractOrCreateKeys(secret, nkeys.CreateAccount)
 	if err != nil {
@@ -168,20 +314,38 @@ func (r *NatsAccountReconciler) reconcileKey(ctx context.Context, secret *corev1
 	seed, _ := keys.Seed()
 	public, _ := keys.PublicKey()
 
+	revocations, err := readRevocations(secret, account)
+	if err != nil {
+		return false, err
+	}
+	if needsKeyUpdate {
+		// JWTs of users issued for a previous key pair aren't valid anymore
+		revocations = userRevocations{}
+	}
+	revocations.prune(append([]string{public}, lo.Map(signingKeys, func(key natsv1alpha1.AccountSigningKeyStatus, _ int) string { return key.PublicKey })...), time.Now())
+	account.Status.Revocations = revocations.list()
+
 	token := jwt.NewAccountClaims(public)
-	token.Account = account.Spec.ToJWTAccount()
+	token.Account = account.Spec.ToJWTAccount(signingKeys, account.Status.Revocations)
 	needsClaimsUpdate := secret.Data == nil
 	signerKp, err := nkeys.FromSeed(signer)
 	if err != nil {
-		return false, fmt.Errorf("failed decoding seed: %v, signer: %v", err, signer)
+		return false, fmt.Errorf("failed decoding seed: %v", err)
 	}
+	signerPublic, _ := signerKp.PublicKey()
 
+	var changes []string
 	if secret.Data != nil {
 		oldToken, err := jwt.DecodeAccountClaims(string(secret.Data[OPERATOR_JWT]))
 		if err == nil {
-			needsClaimsUpdate = needsClaimsUpdate || !reflect.DeepEqual(token.Account, oldToken.Account)
+			// Type and version are only populated while encoding
+			oldToken.Account.GenericFields = token.Account.GenericFields
+			changes = changedFields(oldToken.Account, token.Account)
 			// Check if the signing keys changed
-			needsClaimsUpdate = needsClaimsUpdate || oldToken.Issuer != token.Issuer
+			if oldToken.Issuer != signerPublic {
+				changes = append(changes, "issuer")
+			}
+			needsClaimsUpdate = needsClaimsUpdate || len(changes) > 0
 		} else {
 			// Claims could not be decoded, need update.
 			needsClaimsUpdate = true
@@ -203,13 +367,40 @@ func (r *NatsAccountReconciler) reconcileKey(ctx context.Context, secret *corev1
 			return false, err
 		}
 		secret.Data[OPERATOR_JWT] = []byte(jwt)
+		recordIssued(r.Recorder, account, public, needsKeyUpdate, changes)
+	}
+	needsRevocationsUpdate, err := writeRevocations(secret, revocations)
+	if err != nil {
+		return false, err
 	}
-	return needsKeyUpdate || needsClaimsUpdate, nil
+	return needsKeyUpdate || needsClaimsUpdate || needsRevocationsUpdate, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *NatsAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&natsv1alpha1.NatsAccount{}).
+		// Secrets are not controller owned, so we can't use Owns here
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestForOwner{OwnerType: &natsv1alpha1.NatsAccount{}}).
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsOperator{}}, handler.EnqueueRequestsFromMapFunc(r.findIssuedAccounts), builder.WithPredicates(predicate.Funcs{
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				// Accounts need to be re-issued whenever the signer of the operator changes
+				oldOperator, newOperator := e.ObjectOld.(*natsv1alpha1.NatsOperator), e.ObjectNew.(*natsv1alpha1.NatsOperator)
+				return oldOperator.Status.SignerSecretName != newOperator.Status.SignerSecretName ||
+					oldOperator.Status.SignerPublicKey != newOperator.Status.SignerPublicKey
+			},
+		})).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
+
+// findIssuedAccounts enqueues all accounts issued by the given operator.
+func (r *NatsAccountReconciler) findIssuedAccounts(obj client.Object) []reconcile.Request {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(context.Background(), accounts, client.MatchingFields{OPERATOR_REF_INDEX: indexKey(client.ObjectKeyFromObject(obj))}); err != nil {
+		return nil
+	}
+	return lo.Map(accounts.Items, func(account natsv1alpha1.NatsAccount, _ int) reconcile.Request {
+		return reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&account)}
+	})
+}
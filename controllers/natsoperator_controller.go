@@ -20,25 +20,39 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nkeys"
+	"github.com/samber/lo"
 	corev1 "k8s.io/api/core/v1"
 )
 
 // NatsOperatorReconciler reconciles a NatsOperator object
 type NatsOperatorReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// MaxConcurrentReconciles is the number of operators reconciled in parallel, defaults to 1
+	MaxConcurrentReconciles int
 }
 
 const JWT_OPERATOR_FINALIZER = "nats.deinstapel.de/jwt-operator"
@@ -49,22 +63,31 @@ const OPERATOR_CREDS = "user.creds"
 const OPERATOR_CONFIG_FILE = "auth.conf"
 const AUTH_CONFIG_TEMPLATE = `operator: %s
 system_account: %s
-resolver {
-	type: full
-	dir: './jwt'
-	allow_delete: true
-	interval: "2m"
-	timeout: "5s"
-}
-resolver_preload: {
-	%s: %s,
-}
+%s`
+
+// RESOLVER_PRELOAD_TEMPLATE preloads account JWTs. The full and cache resolvers preload the system account, so the
+// servers can reach the account server before any other account has been resolved, the memory resolver preloads all
+// accounts.
+const RESOLVER_PRELOAD_TEMPLATE = `resolver_preload: {
+%s}
 `
+const RESOLVER_PRELOAD_ACCOUNT_TEMPLATE = "\t%s: %s,\n"
+
+// URL_RESOLVER_TEMPLATE fetches all accounts from the account server, including the system account,
+// as preloading is only supported by the full, cache and memory resolvers.
+const URL_RESOLVER_TEMPLATE = `resolver: URL(%q)
+`
+
+// Defaults of the resolver options, as they have been rendered before the resolver could be configured
+const DEFAULT_RESOLVER_DIR = "./jwt"
+const DEFAULT_RESOLVER_INTERVAL = "2m"
+const DEFAULT_RESOLVER_TIMEOUT = "5s"
 
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsoperators,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsoperators/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsoperators/finalizers,verbs=update
 //+kubebuilder:rbac:groups=,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=,resources=configmaps,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -97,62 +120,88 @@ func (r *NatsOperatorReconciler) Reconcile(ctx context.Context, req ctrl.Request
 			return ctrl.Result{}, err
 		}
 	}
-	needsRewriteConfig, err := r.reconcileSecret(ctx, req, operator)
+	status := operator.Status.DeepCopy()
+	ready, err := r.reconcileOperator(ctx, req, operator)
+	setReadyCondition(&operator.Status.Conditions, operator, ready, err)
+	operator.Status.ObservedGeneration = operator.Generation
+	if !reflect.DeepEqual(status, &operator.Status) {
+		if updateErr := r.Status().Update(ctx, operator); updateErr != nil && err == nil {
+			err = updateErr
+		}
+	}
+	return ctrl.Result{}, err
+}
+
+// reconcileOperator issues the operator together with its system account and user, the results are written
+// to the status of the operator. It returns whether the operator is ready.
+func (r *NatsOperatorReconciler) reconcileOperator(ctx context.Context, req ctrl.Request, operator *natsv1alpha1.NatsOperator) (bool, error) {
+	logger := log.FromContext(ctx)
+	accounts, err := r.listAccounts(ctx, operator)
 	if err != nil {
-		return ctrl.Result{}, err
+		return false, err
+	}
+	signingKeys, err := r.reconcileSigningKeys(ctx, operator, accounts)
+	if err != nil {
+		r.Recorder.Eventf(operator, corev1.EventTypeWarning, "SigningKeysFailed", "Failed to reconcile signing keys: %v", errorMessage(err))
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_KEYS_READY, false, "SigningKeysFailed", errorMessage(err))
+		return false, err
+	}
+	needsRewriteConfig, err := r.reconcileSecret(ctx, req, operator, signingKeys, accounts)
+	if err != nil {
+		r.Recorder.Eventf(operator, corev1.EventTypeWarning, "IssueFailed", "Failed to issue operator: %v", errorMessage(err))
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_JWT_ISSUED, false, "IssueFailed", errorMessage(err))
+		return false, err
+	}
+	setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_KEYS_READY, true, "KeysGenerated", "")
+	if operator.Spec.OfflineRoot != nil {
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_JWT_ISSUED, true, "OfflineRoot", fmt.Sprintf("issued outside of the cluster, accounts are signed by %v", operator.Status.SignerPublicKey))
+	} else {
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_JWT_ISSUED, true, "Issued", fmt.Sprintf("accounts are signed by %v", operator.Status.SignerPublicKey))
 	}
 
 	// Create / reconcile system account
 	systemAccount := &natsv1alpha1.NatsAccount{}
-	systemAccountName := client.ObjectKey{
-		Namespace: req.Namespace,
-		Name:      fmt.Sprintf("%v-system", req.Name),
-	}
-	for {
-		if err := r.Get(ctx, systemAccountName, systemAccount); errors.IsNotFound(err) {
-			logger.Info("creating system account")
-			systemAccount.Name = systemAccountName.Name
-			systemAccount.Namespace = systemAccountName.Namespace
-			if err := controllerutil.SetOwnerReference(operator, systemAccount, r.Scheme); err != nil {
-				return ctrl.Result{}, err
-			}
+	systemAccountName := systemAccountName(req.NamespacedName)
+	if err := r.Get(ctx, systemAccountName, systemAccount); errors.IsNotFound(err) {
+		logger.Info("creating system account")
+		systemAccount.Name = systemAccountName.Name
+		systemAccount.Namespace = systemAccountName.Namespace
+		if err := controllerutil.SetOwnerReference(operator, systemAccount, r.Scheme); err != nil {
+			return false, err
+		}
 
-			systemAccount.Spec = natsv1alpha1.NatsAccountSpec{
-				AllowUserNamespaces: []string{req.Namespace},
-				OperatorRef: corev1.ObjectReference{
-					Namespace: req.Namespace,
-					Name:      req.Name,
+		systemAccount.Spec = natsv1alpha1.NatsAccountSpec{
+			AllowUserNamespaces: []string{req.Namespace},
+			OperatorRef: corev1.ObjectReference{
+				Namespace: req.Namespace,
+				Name:      req.Name,
+			},
+			Limits: natsv1alpha1.OperatorLimits{
+				NatsLimits: jwt.NatsLimits{
+					Subs:    -1,
+					Payload: -1,
+					Data:    -1,
 				},
-				Limits: natsv1alpha1.OperatorLimits{
-					NatsLimits: jwt.NatsLimits{
-						Subs:    -1,
-						Payload: -1,
-						Data:    -1,
-					},
-					AccountLimits: jwt.AccountLimits{
-						Conn:           -1,
-						DisallowBearer: true,
-					},
+				AccountLimits: jwt.AccountLimits{
+					Conn:           -1,
+					DisallowBearer: true,
 				},
-			}
-			if err := r.Create(ctx, systemAccount); err != nil {
-				return ctrl.Result{}, err
-			}
-
-			// After the user has been created, we need to requeue this operator nkey
-			// because we need to enqueue the account and the user in order to create the server config
-			return ctrl.Result{
-				RequeueAfter: 5 * time.Second,
-			}, nil
-		} else if err != nil {
-			return ctrl.Result{}, err
-		} else if systemAccount.Status.JWT == "" {
-			// Object has been found, but JWT hasn't been issued, wait until it has been issued
-			logger.Info("waiting for system account to become ready")
-			<-time.After(5 * time.Second)
-		} else {
-			break
+			},
 		}
+		if err := r.Create(ctx, systemAccount); err != nil {
+			return false, err
+		}
+
+		// The account watch enqueues this operator again once the account has been issued
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_READY, false, "WaitingForSystemAccount", "system account has been created")
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if systemAccount.Status.JWT == "" {
+		// Object has been found, but JWT hasn't been issued, the account watch enqueues us once it has been issued
+		logger.Info("waiting for system account to become ready")
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_READY, false, "WaitingForSystemAccount", "waiting for system account to be issued")
+		return false, nil
 	}
 
 	// Create / reconcile system JWT user
@@ -161,64 +210,85 @@ func (r *NatsOperatorReconciler) Reconcile(ctx context.Context, req ctrl.Request
 		Namespace: req.Namespace,
 		Name:      fmt.Sprintf("%v-jwt", req.Name),
 	}
-	for {
-		if err := r.Get(ctx, systemUserName, systemUser); errors.IsNotFound(err) {
-			logger.Info("creating jwt system user")
-			systemUser.Name = systemUserName.Name
-			systemUser.Namespace = systemUserName.Namespace
-			if err := controllerutil.SetOwnerReference(operator, systemUser, r.Scheme); err != nil {
-				return ctrl.Result{}, err
-			}
-			// Allow this user to publish and subscribe, i.e. interact with the server for JWT permissions
-			systemUser.Spec = natsv1alpha1.NatsUserSpec{
-				AccountRef: corev1.ObjectReference{
-					Namespace: systemAccount.Namespace,
-					Name:      systemAccount.Name,
+	if err := r.Get(ctx, systemUserName, systemUser); errors.IsNotFound(err) {
+		logger.Info("creating jwt system user")
+		systemUser.Name = systemUserName.Name
+		systemUser.Namespace = systemUserName.Namespace
+		if err := controllerutil.SetOwnerReference(operator, systemUser, r.Scheme); err != nil {
+			return false, err
+		}
+		systemUser.Spec = systemUserSpec(systemAccount)
+		if err := r.Create(ctx, systemUser); err != nil {
+			return false, err
+		}
+
+		// The user watch enqueues this operator again once the user has been issued
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_READY, false, "WaitingForSystemUser", "system user has been created")
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if spec := systemUserSpec(systemAccount); !reflect.DeepEqual(systemUser.Spec, spec) {
+		// Permissions required by the account server changed
+		logger.Info("updating jwt system user")
+		systemUser.Spec = spec
+		if err := r.Update(ctx, systemUser); err != nil {
+			return false, err
+		}
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_READY, false, "WaitingForSystemUser", "system user has been updated")
+		return false, nil
+	} else if systemUser.Status.JWT == "" {
+		// Object has been found but jwt not issued yet, the user watch enqueues us once it has been issued
+		logger.Info("waiting for system user to become ready")
+		setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_READY, false, "WaitingForSystemUser", "waiting for system user to be issued")
+		return false, nil
+	}
+
+	return r.reconcileServerConfigSnipped(ctx, req, operator, systemAccount, accounts, needsRewriteConfig)
+}
+
+// systemUserSpec returns the spec of the user the account server connects with.
+func systemUserSpec(systemAccount *natsv1alpha1.NatsAccount) natsv1alpha1.NatsUserSpec {
+	// Allow this user to publish and subscribe, i.e. interact with the server for JWT permissions
+	return natsv1alpha1.NatsUserSpec{
+		AccountRef: corev1.ObjectReference{
+			Namespace: systemAccount.Namespace,
+			Name:      systemAccount.Name,
+		},
+		UserPermissionLimits: natsv1alpha1.UserPermissionLimits{
+			Permissions: natsv1alpha1.Permissions{
+				Pub: natsv1alpha1.Permission{
+					Allow: []string{"$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP", "$SYS.REQ.CLAIMS.UPDATE", "$SYS.REQ.CLAIMS.DELETE"},
 				},
-				Permissions: natsv1alpha1.Permissions{
-					Pub: natsv1alpha1.Permission{
-						Allow: []string{"$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP", "$SYS.REQ.CLAIMS.UPDATE"},
-					},
-					Sub: natsv1alpha1.Permission{
-						Allow: []string{"$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP"},
-					},
-					Resp: &jwt.ResponsePermission{
-						MaxMsgs: 1,
-						Expires: -1,
+				Sub: natsv1alpha1.Permission{
+					// Responses of the servers to updates and deletions are received on the inbox
+					Allow: []string{
+						"$SYS.REQ.ACCOUNT.*.CLAIMS.LOOKUP",
+						"$SYS.REQ.CLAIMS.LIST",
+						"$SYS.REQ.CLAIMS.PACK",
+						"$SYS.REQ.CLAIMS.DELETE",
+						"_INBOX.>",
 					},
 				},
-				Limits: natsv1alpha1.Limits{
-					NatsLimits: jwt.NatsLimits{
-						Subs:    -1,
-						Payload: -1,
-						Data:    -1,
-					},
+				// Pack requests are answered with one message per account
+				Resp: &jwt.ResponsePermission{
+					MaxMsgs: -1,
+					Expires: time.Minute,
 				},
-			}
-			if err := r.Create(ctx, systemUser); err != nil {
-				return ctrl.Result{}, err
-			}
-
-			// After the user has been created, we need to requeue this operator nkey
-			// because we need to enqueue the account and the user in order to create the server config
-			return ctrl.Result{
-				RequeueAfter: 5 * time.Second,
-			}, nil
-		} else if err != nil {
-			return ctrl.Result{}, err
-		} else if systemUser.Status.JWT == "" {
-			// Object has been found but jwt not issued yet
-			logger.Info("waiting for system user to become ready")
-			<-time.After(5 * time.Second)
-		} else {
-			break
-		}
+			},
+			Limits: natsv1alpha1.Limits{
+				NatsLimits: jwt.NatsLimits{
+					Subs:    -1,
+					Payload: -1,
+					Data:    -1,
+				},
+			},
+		},
 	}
-
-	return ctrl.Result{}, r.reconcileServerConfigSnipped(ctx, req, operator, systemAccount, needsRewriteConfig)
 }
 
-func (r *NatsOperatorReconciler) reconcileServerConfigSnipped(ctx context.Context, req ctrl.Request, operator *natsv1alpha1.NatsOperator, sysacc *natsv1alpha1.NatsAccount, needsRefresh bool) error {
+// reconcileServerConfigSnipped renders the server configuration snippet into a secret. Invalid configurations
+// are reported in the status instead of being rendered, the secret keeps the last valid configuration.
+func (r *NatsOperatorReconciler) reconcileServerConfigSnipped(ctx context.Context, req ctrl.Request, operator *natsv1alpha1.NatsOperator, sysacc *natsv1alpha1.NatsAccount, accounts []natsv1alpha1.NatsAccount, needsRefresh bool) (bool, error) {
 	logger := log.FromContext(ctx)
 	// Finally, reconcile server configuration snippet
 	serverConfig := &corev1.Secret{}
@@ -234,9 +304,45 @@ func (r *NatsOperatorReconciler) reconcileServerConfigSnipped(ctx context.Contex
 		serverConfig.Type = "deinstapel.de/nats-configuration"
 		hasSecret = false
 	} else if err != nil {
-		return err
+		return false, err
+	}
+	resolver, err := renderResolver(operator, sysacc, accounts)
+	if err != nil {
+		setConfigInvalid(operator, "InvalidResolver", errorMessage(err))
+		return false, nil
+	}
+	trusted, invalid, err := r.trustedOperators(ctx, operator)
+	if err != nil {
+		return false, err
+	} else if invalid != "" {
+		setConfigInvalid(operator, "InvalidTrustedOperator", invalid)
+		return false, nil
 	}
-	text := fmt.Sprintf(AUTH_CONFIG_TEMPLATE, operator.Status.JWT, sysacc.Status.PublicKey, sysacc.Status.PublicKey, sysacc.Status.JWT)
+	text := fmt.Sprintf(AUTH_CONFIG_TEMPLATE, renderOperators(operator.Status.JWT, trusted), sysacc.Status.PublicKey, resolver)
+	if configTemplate := operator.Spec.ConfigTemplate; configTemplate != nil {
+		configMap := &corev1.ConfigMap{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: configTemplate.ConfigMapName}, configMap); errors.IsNotFound(err) {
+			// The config map watch enqueues us once it has been created, only labeled config maps are cached
+			setConfigInvalid(operator, "TemplateNotFound", fmt.Sprintf("config map %v with label %v=true not found", configTemplate.ConfigMapName, CONFIG_TEMPLATE_LABEL))
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		source, ok := configMap.Data[configTemplateKey(configTemplate)]
+		if !ok {
+			setConfigInvalid(operator, "TemplateNotFound", fmt.Sprintf("config map %v has no key %v", configTemplate.ConfigMapName, configTemplateKey(configTemplate)))
+			return false, nil
+		}
+		data, err := r.serverConfigData(ctx, operator, trusted, sysacc, accounts, resolver, text)
+		if err != nil {
+			return false, err
+		}
+		if text, err = renderConfigTemplate(source, data); err != nil {
+			setConfigInvalid(operator, "InvalidTemplate", errorMessage(err))
+			return false, nil
+		}
+	}
+	previous := serverConfig.DeepCopy()
 	if !needsRefresh && serverConfig.Data != nil {
 		needsRefresh = needsRefresh || text != string(serverConfig.Data[OPERATOR_CONFIG_FILE])
 	}
@@ -248,17 +354,255 @@ func (r *NatsOperatorReconciler) reconcileServerConfigSnipped(ctx context.Contex
 	}
 
 	if err := controllerutil.SetOwnerReference(operator, serverConfig, r.Scheme); err != nil {
-		return err
+		return false, err
 	}
 
 	if !hasSecret {
-		return r.Create(ctx, serverConfig)
+		err = r.Create(ctx, serverConfig)
+	} else if !reflect.DeepEqual(previous, serverConfig) {
+		// The config is rendered on every reconcile, only write it once it changed
+		err = r.Update(ctx, serverConfig)
+	}
+	if err != nil {
+		return false, err
+	}
+	setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_CONFIG_RENDERED, true, "Rendered", "")
+	return true, nil
+}
+
+// setConfigInvalid reports a server configuration that can't be rendered, the secret keeps the last valid configuration.
+func setConfigInvalid(operator *natsv1alpha1.NatsOperator, reason string, message string) {
+	setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_CONFIG_RENDERED, false, reason, message)
+	setCondition(&operator.Status.Conditions, operator, natsv1alpha1.CONDITION_READY, false, reason, message)
+}
+
+// renderResolver renders the resolver configuration selected in the spec of the operator. The memory resolver
+// preloads all ready accounts of the operator.
+func renderResolver(operator *natsv1alpha1.NatsOperator, sysacc *natsv1alpha1.NatsAccount, accounts []natsv1alpha1.NatsAccount) (string, error) {
+	resolver := operator.Spec.Resolver
+	if resolver == nil {
+		resolver = &natsv1alpha1.Resolver{}
+	}
+	if err := validateResolver(resolver); err != nil {
+		return "", err
+	}
+	preload := renderPreload([]natsv1alpha1.NatsAccount{*sysacc})
+	switch resolver.Type {
+	case natsv1alpha1.RESOLVER_URL:
+		return fmt.Sprintf(URL_RESOLVER_TEMPLATE, resolver.URL), nil
+	case natsv1alpha1.RESOLVER_MEMORY:
+		readyAccounts := lo.Filter(accounts, func(account natsv1alpha1.NatsAccount, _ int) bool {
+			return account.DeletionTimestamp == nil && account.Status.JWT != "" &&
+				meta.IsStatusConditionTrue(account.Status.Conditions, natsv1alpha1.CONDITION_READY)
+		})
+		return "resolver: MEMORY\n" + renderPreload(append(readyAccounts, *sysacc)), nil
+	}
+
+	resolverType := lo.Ternary(resolver.Type == "", natsv1alpha1.RESOLVER_FULL, resolver.Type)
+	text := &strings.Builder{}
+	fmt.Fprintf(text, "resolver {\n\ttype: %v\n", resolverType)
+	fmt.Fprintf(text, "\tdir: %q\n", lo.Ternary(resolver.Dir == "", DEFAULT_RESOLVER_DIR, resolver.Dir))
+	if resolverType == natsv1alpha1.RESOLVER_FULL {
+		fmt.Fprintf(text, "\tallow_delete: %v\n", resolver.AllowDelete == nil || *resolver.AllowDelete)
+		fmt.Fprintf(text, "\tinterval: %q\n", lo.Ternary(resolver.Interval == "", DEFAULT_RESOLVER_INTERVAL, resolver.Interval))
+	}
+	fmt.Fprintf(text, "\ttimeout: %q\n", lo.Ternary(resolver.Timeout == "", DEFAULT_RESOLVER_TIMEOUT, resolver.Timeout))
+	if resolver.Limit > 0 {
+		fmt.Fprintf(text, "\tlimit: %v\n", resolver.Limit)
+	}
+	if resolver.TTL != "" {
+		fmt.Fprintf(text, "\tttl: %q\n", resolver.TTL)
 	}
+	text.WriteString("}\n")
+	text.WriteString(preload)
+	return text.String(), nil
+}
+
+// renderPreload renders the resolver_preload map of the accounts, sorted by their public key.
+func renderPreload(accounts []natsv1alpha1.NatsAccount) string {
+	jwts := map[string]string{}
+	for _, account := range accounts {
+		jwts[account.Status.PublicKey] = account.Status.JWT
+	}
+	publicKeys := lo.Keys(jwts)
+	sort.Strings(publicKeys)
+	entries := &strings.Builder{}
+	for _, publicKey := range publicKeys {
+		fmt.Fprintf(entries, RESOLVER_PRELOAD_ACCOUNT_TEMPLATE, publicKey, jwts[publicKey])
+	}
+	return fmt.Sprintf(RESOLVER_PRELOAD_TEMPLATE, entries.String())
+}
+
+// validateResolver rejects options the selected type of resolver doesn't support, the NATS servers would
+// refuse to start with them.
+func validateResolver(resolver *natsv1alpha1.Resolver) error {
+	resolverType := lo.Ternary(resolver.Type == "", natsv1alpha1.RESOLVER_FULL, resolver.Type)
+	unsupported := map[string]bool{}
+	switch resolverType {
+	case natsv1alpha1.RESOLVER_FULL:
+		unsupported["url"] = resolver.URL != ""
+		unsupported["ttl"] = resolver.TTL != ""
+	case natsv1alpha1.RESOLVER_CACHE:
+		unsupported["url"] = resolver.URL != ""
+		unsupported["interval"] = resolver.Interval != ""
+		unsupported["allowDelete"] = resolver.AllowDelete != nil
+	case natsv1alpha1.RESOLVER_MEMORY, natsv1alpha1.RESOLVER_URL:
+		unsupported["url"] = resolverType == natsv1alpha1.RESOLVER_MEMORY && resolver.URL != ""
+		unsupported["dir"] = resolver.Dir != ""
+		unsupported["interval"] = resolver.Interval != ""
+		unsupported["timeout"] = resolver.Timeout != ""
+		unsupported["allowDelete"] = resolver.AllowDelete != nil
+		unsupported["limit"] = resolver.Limit != 0
+		unsupported["ttl"] = resolver.TTL != ""
+	default:
+		return fmt.Errorf("unknown resolver type %v", resolver.Type)
+	}
+	if options := lo.Keys(lo.PickBy(unsupported, func(_ string, set bool) bool { return set })); len(options) > 0 {
+		sort.Strings(options)
+		return fmt.Errorf("the %v resolver doesn't support %v", resolverType, strings.Join(options, ", "))
+	}
+	if resolverType == natsv1alpha1.RESOLVER_URL && resolver.URL == "" {
+		return fmt.Errorf("the url resolver requires the url of the account server")
+	}
+	for option, value := range map[string]string{"interval": resolver.Interval, "timeout": resolver.Timeout, "ttl": resolver.TTL} {
+		if value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+			return fmt.Errorf("the %v of the resolver must be a positive duration, got %q", option, value)
+		}
+	}
+	return nil
+}
 
-	return r.Update(ctx, serverConfig)
+// listAccounts returns all accounts issued by the given operator.
+func (r *NatsOperatorReconciler) listAccounts(ctx context.Context, operator *natsv1alpha1.NatsOperator) ([]natsv1alpha1.NatsAccount, error) {
+	accounts := &natsv1alpha1.NatsAccountList{}
+	if err := r.List(ctx, accounts, client.MatchingFields{OPERATOR_REF_INDEX: indexKey(client.ObjectKeyFromObject(operator))}); err != nil {
+		return nil, err
+	}
+	return accounts.Items, nil
+}
+
+// accountIssuer returns the public key the current JWT of the account has been signed with.
+func accountIssuer(account *natsv1alpha1.NatsAccount) string {
+	token, err := jwt.DecodeAccountClaims(account.Status.JWT)
+	if err != nil {
+		return ""
+	}
+	return token.Issuer
+}
+
+func countAccountsSignedBy(accounts []natsv1alpha1.NatsAccount, publicKey string) int {
+	return lo.CountBy(accounts, func(account natsv1alpha1.NatsAccount) bool { return accountIssuer(&account) == publicKey })
+}
+
+// countAccountsDependingOn counts the accounts a retiring signing key is still needed for: accounts signed by it
+// and re-issued accounts whose JWT hasn't been pushed yet, as the servers still hold the JWT signed by it.
+func countAccountsDependingOn(accounts []natsv1alpha1.NatsAccount, publicKey string) int {
+	return lo.CountBy(accounts, func(account natsv1alpha1.NatsAccount) bool {
+		return accountIssuer(&account) == publicKey || !isPushed(&account)
+	})
+}
+
+// isPushed reports whether the current JWT of the account has been pushed. Accounts without a Pushed condition
+// aren't served by an account server, the servers resolve their current JWT on their own.
+func isPushed(account *natsv1alpha1.NatsAccount) bool {
+	if meta.FindStatusCondition(account.Status.Conditions, natsv1alpha1.CONDITION_PUSHED) == nil {
+		return true
+	}
+	return meta.IsStatusConditionTrue(account.Status.Conditions, natsv1alpha1.CONDITION_PUSHED) &&
+		account.Status.Push != nil && account.Status.Push.JWTHash == jwtHash(account.Status.JWT)
+}
+
+// reconcileSigningKeys ensures a secret with a key pair exists for every managed signing key of the operator.
+// Signing keys that have been dropped from the spec are retired: they stay in the operator JWT until no account
+// is signed by them anymore and the re-issued accounts have been pushed, afterwards their secret is removed.
+func (r *NatsOperatorReconciler) reconcileSigningKeys(ctx context.Context, operator *natsv1alpha1.NatsOperator, accounts []natsv1alpha1.NatsAccount) ([]natsv1alpha1.OperatorSigningKeyStatus, error) {
+	logger := log.FromContext(ctx)
+	if operator.Spec.OfflineRoot != nil && len(operator.Spec.ManagedSigningKeys) > 0 {
+		return nil, fmt.Errorf("managed signing keys can't be used with an offline root, the operator JWT is issued outside of the cluster")
+	}
+	var signingKeys []natsv1alpha1.OperatorSigningKeyStatus
+	for _, key := range operator.Spec.ManagedSigningKeys {
+		previous, _ := lo.Find(operator.Status.SigningKeys, func(k natsv1alpha1.OperatorSigningKeyStatus) bool { return k.Name == key.Name })
+		keySecretName := signingKeySecretName(operator, "operator", key.Name, previous.SecretName)
+		public, err := reconcileSigningKeySecret(ctx, r.Client, r.Scheme, operator, keySecretName, "deinstapel.de/nats-operator-signing-key", nkeys.CreateOperator)
+		if err != nil {
+			return nil, err
+		}
+		signingKeys = append(signingKeys, natsv1alpha1.OperatorSigningKeyStatus{
+			Name:       key.Name,
+			SecretName: keySecretName.Name,
+			PublicKey:  public,
+			Accounts:   countAccountsSignedBy(accounts, public),
+		})
+	}
+
+	for _, key := range operator.Status.SigningKeys {
+		if lo.ContainsBy(signingKeys, func(k natsv1alpha1.OperatorSigningKeyStatus) bool { return k.SecretName == key.SecretName }) {
+			continue
+		}
+		if key.Accounts = countAccountsDependingOn(accounts, key.PublicKey); key.Accounts > 0 && operator.Spec.OfflineRoot == nil {
+			logger.Info("retiring operator signing key, waiting for accounts to be re-issued", "name", key.Name, "accounts", key.Accounts)
+			key.Retiring = true
+			signingKeys = append(signingKeys, key)
+			continue
+		}
+		logger.Info("removing operator signing key", "name", key.Name)
+		if err := deleteSecret(ctx, r.Client, client.ObjectKey{Namespace: operator.Namespace, Name: key.SecretName}); err != nil {
+			return nil, err
+		}
+	}
+	return signingKeys, nil
+}
+
+// signer returns the name of the secret containing the seed accounts should be signed with and its public key.
+func signer(operator *natsv1alpha1.NatsOperator, operatorKeySecret *corev1.Secret, signingKeys []natsv1alpha1.OperatorSigningKeyStatus) (string, string, error) {
+	activeKeys := lo.Filter(signingKeys, func(k natsv1alpha1.OperatorSigningKeyStatus, _ int) bool { return !k.Retiring })
+	if len(activeKeys) == 0 {
+		return operatorKeySecret.Name, string(operatorKeySecret.Data[OPERATOR_PUBLIC_KEY]), nil
+	}
+	if operator.Spec.AccountSigningKey == "" {
+		return activeKeys[0].SecretName, activeKeys[0].PublicKey, nil
+	}
+	key, ok := lo.Find(activeKeys, func(k natsv1alpha1.OperatorSigningKeyStatus) bool { return k.Name == operator.Spec.AccountSigningKey })
+	if !ok {
+		return "", "", fmt.Errorf("account signing key %v is not a managed signing key", operator.Spec.AccountSigningKey)
+	}
+	return key.SecretName, key.PublicKey, nil
+}
+
+// signingKeyRotation reports the accounts that haven't been re-issued with the current signer yet.
+func signingKeyRotation(accounts []natsv1alpha1.NatsAccount, signerPublic string) *natsv1alpha1.SigningKeyRotationStatus {
+	rotation := &natsv1alpha1.SigningKeyRotationStatus{}
+	for _, account := range accounts {
+		if account.Status.JWT == "" {
+			// Not issued yet, will be signed with the current signer anyways
+			continue
+		}
+		if accountIssuer(&account) == signerPublic {
+			rotation.Reissued++
+		} else {
+			rotation.PendingAccounts = append(rotation.PendingAccounts, account.Name)
+		}
+	}
+	if len(rotation.PendingAccounts) == 0 {
+		return nil
+	}
+	return rotation
 }
 
-func (r *NatsOperatorReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, operator *natsv1alpha1.NatsOperator) (bool, error) {
+func (r *NatsOperatorReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, operator *natsv1alpha1.NatsOperator, signingKeys []natsv1alpha1.OperatorSigningKeyStatus, accounts []natsv1alpha1.NatsAccount) (bool, error) {
+	// The system account is issued by the operator, the operator is re-issued once it's known
+	systemAccountPublicKey := ""
+	if systemAccount, ok := lo.Find(accounts, func(account natsv1alpha1.NatsAccount) bool { return isSystemAccount(&account) }); ok {
+		systemAccountPublicKey = systemAccount.Status.PublicKey
+	}
+	if operator.Spec.OfflineRoot != nil {
+		return r.reconcileOfflineRootSecret(ctx, operator, accounts, systemAccountPublicKey)
+	}
+
 	// Try reconcile the secret containing the seed key for the operator
 	logger := log.FromContext(ctx)
 	operatorKeySecret := &corev1.Secret{}
@@ -277,10 +621,15 @@ func (r *NatsOperatorReconciler) reconcileSecret(ctx context.Context, req ctrl.R
 	}
 
 	logger.Info("reconciling operator keys")
-	hasChanges, err := r.reconcileKey(ctx, operatorKeySecret, operator)
+	hasChanges, err := r.reconcileKey(ctx, operatorKeySecret, operator, signingKeys, systemAccountPublicKey)
+	if err != nil {
+		return false, err
+	}
+	signerSecret, signerPublic, err := signer(operator, operatorKeySecret, signingKeys)
 	if err != nil {
 		return false, err
 	}
+	rotation := signingKeyRotation(accounts, signerPublic)
 
 	if !hasSecret {
 		if err := r.Create(ctx, operatorKeySecret); err != nil {
@@ -293,18 +642,72 @@ func (r *NatsOperatorReconciler) reconcileSecret(ctx context.Context, req ctrl.R
 	}
 
 	if !hasSecret || hasChanges {
-		// Update operator status if we encountered changes
-		operator.Status.OperatorSecretName = operatorKeySecret.Name
-		operator.Status.PublicKey = string(operatorKeySecret.Data[OPERATOR_PUBLIC_KEY])
-		operator.Status.JWT = string(operatorKeySecret.Data[OPERATOR_JWT])
-		if err := r.Status().Update(ctx, operator); err != nil {
-			return false, err
-		}
+		operator.Status.LastIssued = &metav1.Time{Time: time.Now()}
 	}
+	operator.Status.OperatorSecretName = operatorKeySecret.Name
+	operator.Status.PublicKey = string(operatorKeySecret.Data[OPERATOR_PUBLIC_KEY])
+	operator.Status.JWT = string(operatorKeySecret.Data[OPERATOR_JWT])
+	operator.Status.SigningKeys = signingKeys
+	operator.Status.SignerSecretName = signerSecret
+	operator.Status.SignerPublicKey = signerPublic
+	operator.Status.SigningKeyRotation = rotation
 	return !hasSecret || hasChanges, nil
 }
 
-func (r *NatsOperatorReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, operator *natsv1alpha1.NatsOperator) (bool, error) {
+// reconcileOfflineRootSecret validates the user supplied secret of an offline root operator:
+// The operator JWT must list the signing key, which is then used to sign all accounts. A system account in the
+// operator JWT must be the generated one, which the servers, the account server and the $NAME-jwt user use.
+func (r *NatsOperatorReconciler) reconcileOfflineRootSecret(ctx context.Context, operator *natsv1alpha1.NatsOperator, accounts []natsv1alpha1.NatsAccount, systemAccountPublicKey string) (bool, error) {
+	logger := log.FromContext(ctx)
+	spec := operator.Spec
+	if spec.AccountServerURL != "" || len(spec.OperatorServiceURLs) > 0 || spec.SystemAccount != "" || spec.StrictSigningKeyUsage || spec.AssertServerVersion != "" || len(spec.Tags) > 0 {
+		return false, fmt.Errorf("operator claims can't be set with an offline root, the operator JWT is issued outside of the cluster")
+	}
+	offlineRootSecret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{
+		Namespace: operator.Namespace,
+		Name:      operator.Spec.OfflineRoot.SecretName,
+	}, offlineRootSecret); err != nil {
+		return false, err
+	}
+
+	logger.Info("validating offline root operator")
+	operatorJWT := string(offlineRootSecret.Data[OPERATOR_JWT])
+	token, err := jwt.DecodeOperatorClaims(operatorJWT)
+	if err != nil {
+		return false, fmt.Errorf("failed decoding operator jwt of offline root: %v", err)
+	}
+	signerKp, err := nkeys.FromSeed(offlineRootSecret.Data[OPERATOR_SEED_KEY])
+	if err != nil {
+		return false, fmt.Errorf("failed decoding signing key seed of offline root: %v", err)
+	}
+	signerPublic, _ := signerKp.PublicKey()
+	if !nkeys.IsValidPublicOperatorKey(signerPublic) {
+		return false, fmt.Errorf("signing key %v of offline root is not an operator key", signerPublic)
+	}
+	if !token.SigningKeys.Contains(signerPublic) {
+		return false, fmt.Errorf("signing key %v is not listed in the operator jwt of offline root", signerPublic)
+	}
+	if token.SystemAccount != "" && systemAccountPublicKey != "" && token.SystemAccount != systemAccountPublicKey {
+		return false, fmt.Errorf("operator jwt of offline root names system account %v instead of the generated system account %v", token.SystemAccount, systemAccountPublicKey)
+	}
+
+	rotation := signingKeyRotation(accounts, signerPublic)
+	hasChanges := operator.Status.JWT != operatorJWT
+	if hasChanges {
+		operator.Status.LastIssued = &metav1.Time{Time: time.Now()}
+	}
+	operator.Status.OperatorSecretName = offlineRootSecret.Name
+	operator.Status.PublicKey = token.Subject
+	operator.Status.JWT = operatorJWT
+	operator.Status.SigningKeys = nil
+	operator.Status.SignerSecretName = offlineRootSecret.Name
+	operator.Status.SignerPublicKey = signerPublic
+	operator.Status.SigningKeyRotation = rotation
+	return hasChanges, nil
+}
+
+func (r *NatsOperatorReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, operator *natsv1alpha1.NatsOperator, signingKeys []natsv1alpha1.OperatorSigningKeyStatus, systemAccountPublicKey string) (bool, error) {
 	logger := log.FromContext(ctx)
 	keys, needsKeyUpdate, err := extractOrCreateKeys(secret, nkeys.CreateOperator)
 	if err != nil {
@@ -315,13 +718,40 @@ func (r *NatsOperatorReconciler) reconcileKey(ctx context.Context, secret *corev
 	public, _ := keys.PublicKey()
 
 	token := jwt.NewOperatorClaims(public)
-	token.Operator.SigningKeys = operator.Spec.SigningKeys
+	token.Operator.SigningKeys.Add(operator.Spec.SigningKeys...)
+	for _, key := range signingKeys {
+		token.Operator.SigningKeys.Add(key.PublicKey)
+	}
+	token.Operator.AccountServerURL = operator.Spec.AccountServerURL
+	token.Operator.OperatorServiceURLs.Add(operator.Spec.OperatorServiceURLs...)
+	// The servers, the account server and the $NAME-jwt user all use the generated system account, so the
+	// spec can only pin it
+	if operator.Spec.SystemAccount != "" && systemAccountPublicKey != "" && operator.Spec.SystemAccount != systemAccountPublicKey {
+		return false, fmt.Errorf("system account %v is not the generated system account %v", operator.Spec.SystemAccount, systemAccountPublicKey)
+	}
+	token.Operator.SystemAccount = systemAccountPublicKey
+	token.Operator.StrictSigningKeyUsage = operator.Spec.StrictSigningKeyUsage
+	token.Operator.AssertServerVersion = operator.Spec.AssertServerVersion
+	token.Operator.Tags.Add(operator.Spec.Tags...)
+	if token.Operator.StrictSigningKeyUsage && len(signingKeys) == 0 {
+		return false, fmt.Errorf("strict signing key usage requires managed signing keys to sign accounts with")
+	}
+	validation := jwt.CreateValidationResults()
+	token.Validate(validation)
+	if err := kerrors.NewAggregate(validation.Errors()); err != nil {
+		return false, fmt.Errorf("invalid operator claims: %v", err)
+	}
 	needsClaimsUpdate := secret.Data == nil
 
+	var changes []string
 	if secret.Data != nil {
 		oldToken, err := jwt.DecodeOperatorClaims(string(secret.Data[OPERATOR_JWT]))
 		if err == nil {
-			needsClaimsUpdate = needsClaimsUpdate || !reflect.DeepEqual(token.Operator.SigningKeys, oldToken.Operator.SigningKeys)
+			// Type and version are only populated while encoding
+			oldToken.Operator.Type = token.Operator.Type
+			oldToken.Operator.Version = token.Operator.Version
+			changes = changedFields(oldToken.Operator, token.Operator)
+			needsClaimsUpdate = needsClaimsUpdate || len(changes) > 0
 		} else {
 			// Claims could not be decoded, need update.
 			needsClaimsUpdate = true
@@ -344,6 +774,7 @@ func (r *NatsOperatorReconciler) reconcileKey(ctx context.Context, secret *corev
 			return false, err
 		}
 		secret.Data[OPERATOR_JWT] = []byte(jwt)
+		recordIssued(r.Recorder, operator, public, needsKeyUpdate, changes)
 	}
 	return needsKeyUpdate || needsClaimsUpdate, nil
 }
@@ -352,5 +783,80 @@ func (r *NatsOperatorReconciler) reconcileKey(ctx context.Context, secret *corev
 func (r *NatsOperatorReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&natsv1alpha1.NatsOperator{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestForOwner{OwnerType: &natsv1alpha1.NatsOperator{}}).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.findOfflineRootOperators)).
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsAccount{}}, handler.EnqueueRequestsFromMapFunc(findIssuingOperator)).
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsUser{}}, &handler.EnqueueRequestForOwner{OwnerType: &natsv1alpha1.NatsOperator{}}).
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsUser{}}, handler.EnqueueRequestsFromMapFunc(r.findTemplatedOperatorOfUser)).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.findTemplatedOperators)).
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsOperator{}}, handler.EnqueueRequestsFromMapFunc(r.findTrustingOperators)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
+
+// findIssuingOperator enqueues the operator of an account, so signing key rotations can progress once accounts are re-issued.
+func findIssuingOperator(obj client.Object) []reconcile.Request {
+	account, ok := obj.(*natsv1alpha1.NatsAccount)
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: operatorRef(account)}}
+}
+
+// findOfflineRootOperators enqueues the offline root operators referencing the given secret,
+// as the secret is not owned by them.
+func (r *NatsOperatorReconciler) findOfflineRootOperators(obj client.Object) []reconcile.Request {
+	operators := &natsv1alpha1.NatsOperatorList{}
+	if err := r.List(context.Background(), operators, client.MatchingFields{OFFLINE_ROOT_INDEX: indexKey(client.ObjectKeyFromObject(obj))}); err != nil {
+		return nil
+	}
+	return lo.Map(operators.Items, func(operator natsv1alpha1.NatsOperator, _ int) reconcile.Request {
+		return reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&operator)}
+	})
+}
+
+// findTemplatedOperators enqueues the operators rendering their server configuration with the template in the
+// given config map.
+func (r *NatsOperatorReconciler) findTemplatedOperators(obj client.Object) []reconcile.Request {
+	operators := &natsv1alpha1.NatsOperatorList{}
+	if err := r.List(context.Background(), operators, client.MatchingFields{CONFIG_TEMPLATE_INDEX: indexKey(client.ObjectKeyFromObject(obj))}); err != nil {
+		return nil
+	}
+	return lo.Map(operators.Items, func(operator natsv1alpha1.NatsOperator, _ int) reconcile.Request {
+		return reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&operator)}
+	})
+}
+
+// findTemplatedOperatorOfUser enqueues the operator of the account of a user, if the operator renders its server
+// configuration with a template, as the users are part of its data model.
+func (r *NatsOperatorReconciler) findTemplatedOperatorOfUser(obj client.Object) []reconcile.Request {
+	user, ok := obj.(*natsv1alpha1.NatsUser)
+	if !ok {
+		return nil
+	}
+	account := &natsv1alpha1.NatsAccount{}
+	if err := r.Get(context.Background(), accountRef(user), account); err != nil {
+		return nil
+	}
+	operator := &natsv1alpha1.NatsOperator{}
+	if err := r.Get(context.Background(), operatorRef(account), operator); err != nil || operator.Spec.ConfigTemplate == nil {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKeyFromObject(operator)}}
+}
+
+// findTrustingOperators enqueues the operators trusting the given operator, their server configuration contains
+// its JWT.
+func (r *NatsOperatorReconciler) findTrustingOperators(obj client.Object) []reconcile.Request {
+	operators := &natsv1alpha1.NatsOperatorList{}
+	if err := r.List(context.Background(), operators, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, operator := range operators.Items {
+		if lo.ContainsBy(operator.Spec.TrustedOperators, func(trusted natsv1alpha1.TrustedOperator) bool { return trusted.Name == obj.GetName() }) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&operator)})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,481 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats-server/v2/conf"
+	"github.com/nats-io/nkeys"
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestRenderResolver(t *testing.T) {
+	sysacc := &natsv1alpha1.NatsAccount{}
+	sysacc.Status.PublicKey = "ASYS"
+	sysacc.Status.JWT = "sys.jwt"
+
+	for name, test := range map[string]struct {
+		resolver *natsv1alpha1.Resolver
+		contains []string
+		excludes []string
+		err      string
+	}{
+		"default": {
+			contains: []string{"type: full", `dir: "./jwt"`, "allow_delete: true", `interval: "2m"`, `timeout: "5s"`, "ASYS: sys.jwt"},
+			excludes: []string{"limit", "ttl"},
+		},
+		"full": {
+			resolver: &natsv1alpha1.Resolver{Type: natsv1alpha1.RESOLVER_FULL, Dir: "/data/jwt", Interval: "10m", Timeout: "30s", AllowDelete: lo.ToPtr(false), Limit: 500},
+			contains: []string{"type: full", `dir: "/data/jwt"`, "allow_delete: false", `interval: "10m"`, `timeout: "30s"`, "limit: 500"},
+		},
+		"cache": {
+			resolver: &natsv1alpha1.Resolver{Type: natsv1alpha1.RESOLVER_CACHE, TTL: "1h", Limit: 100},
+			contains: []string{"type: cache", `ttl: "1h"`, "limit: 100", "ASYS: sys.jwt"},
+			excludes: []string{"allow_delete", "interval"},
+		},
+		"memory": {
+			resolver: &natsv1alpha1.Resolver{Type: natsv1alpha1.RESOLVER_MEMORY},
+			contains: []string{"resolver: MEMORY", "ASYS: sys.jwt"},
+		},
+		"url": {
+			resolver: &natsv1alpha1.Resolver{Type: natsv1alpha1.RESOLVER_URL, URL: "http://account-server:9090/jwt/v1/accounts/"},
+			contains: []string{`resolver: URL("http://account-server:9090/jwt/v1/accounts/")`},
+			excludes: []string{"resolver_preload"},
+		},
+		"url without url": {
+			resolver: &natsv1alpha1.Resolver{Type: natsv1alpha1.RESOLVER_URL},
+			err:      "requires the url",
+		},
+		"ttl on full": {
+			resolver: &natsv1alpha1.Resolver{TTL: "1h"},
+			err:      "full resolver doesn't support ttl",
+		},
+		"interval on cache": {
+			resolver: &natsv1alpha1.Resolver{Type: natsv1alpha1.RESOLVER_CACHE, Interval: "2m", AllowDelete: lo.ToPtr(true)},
+			err:      "cache resolver doesn't support allowDelete, interval",
+		},
+		"dir on memory": {
+			resolver: &natsv1alpha1.Resolver{Type: natsv1alpha1.RESOLVER_MEMORY, Dir: "./jwt"},
+			err:      "memory resolver doesn't support dir",
+		},
+		"invalid duration": {
+			resolver: &natsv1alpha1.Resolver{Timeout: "5"},
+			err:      "timeout of the resolver must be a positive duration",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			operator := &natsv1alpha1.NatsOperator{}
+			operator.Spec.Resolver = test.resolver
+			text, err := renderResolver(operator, sysacc, nil)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range test.contains {
+				if !strings.Contains(text, s) {
+					t.Errorf("expected %q in\n%v", s, text)
+				}
+			}
+			for _, s := range test.excludes {
+				if strings.Contains(text, s) {
+					t.Errorf("unexpected %q in\n%v", s, text)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderMemoryResolverPreload(t *testing.T) {
+	sysacc := &natsv1alpha1.NatsAccount{}
+	sysacc.Status.PublicKey = "ASYS"
+	sysacc.Status.JWT = "sys.jwt"
+	account := func(publicKey string, ready bool) natsv1alpha1.NatsAccount {
+		account := natsv1alpha1.NatsAccount{}
+		account.Status.PublicKey = publicKey
+		account.Status.JWT = strings.ToLower(publicKey) + ".jwt"
+		setCondition(&account.Status.Conditions, &account, natsv1alpha1.CONDITION_READY, ready, "Test", "")
+		return account
+	}
+	deleting := account("ADELETING", true)
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Spec.Resolver = &natsv1alpha1.Resolver{Type: natsv1alpha1.RESOLVER_MEMORY}
+	text, err := renderResolver(operator, sysacc, []natsv1alpha1.NatsAccount{account("AREADY", true), account("APENDING", false), deleting, *sysacc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "resolver: MEMORY\nresolver_preload: {\n\tAREADY: aready.jwt,\n\tASYS: sys.jwt,\n}\n"
+	if text != expected {
+		t.Fatalf("expected\n%v\ngot\n%v", expected, text)
+	}
+}
+
+func TestRenderConfigTemplate(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	operator, _, signingKey := issueOperator(t)
+	operator.Namespace = "nats"
+	sysacc := issueAccount(t, signingKey)
+	sysacc.Namespace = "nats"
+	sysacc.Name = "operator-system"
+	account := issueAccount(t, signingKey)
+	account.Namespace = "nats"
+	account.Spec.OperatorRef.Name = operator.Name
+	setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_READY, true, "Reconciled", "")
+	leaf := &natsv1alpha1.NatsUser{}
+	leaf.Namespace = "apps"
+	leaf.Name = "leaf"
+	leaf.Spec.AccountRef.Namespace = "nats"
+	leaf.Spec.AccountRef.Name = account.Name
+	leaf.Status.UserSecretName = "leaf"
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(leaf).
+		WithIndex(&natsv1alpha1.NatsUser{}, ACCOUNT_REF_INDEX, accountRefIndex).Build()
+	r := &NatsOperatorReconciler{Client: k8s, Scheme: scheme}
+
+	data, err := r.serverConfigData(context.Background(), operator, nil, sysacc, []natsv1alpha1.NatsAccount{*account, *sysacc}, "resolver: MEMORY\n", "default\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := renderConfigTemplate(`{{ .Config }}no_auth_user: {{ (index .Users 0).Name }}
+leafnodes {
+  remotes: [{{ range .Users }}
+    { url: "tls://hub:7422", credentials: "/etc/nats/{{ .SecretName }}/user.creds", account: {{ $.SystemAccount.PublicKey }} },{{ end }}
+  ]
+}
+# {{ len .Accounts }} accounts, first ready: {{ (index .Accounts 0).Ready }}, signing keys: {{ len .Operator.SigningKeys }}
+`, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"default\nno_auth_user: leaf\n", `credentials: "/etc/nats/leaf/user.creds", account: ` + sysacc.Status.PublicKey, "# 2 accounts, first ready: true, signing keys: 1"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("expected %q in\n%v", s, text)
+		}
+	}
+
+	if _, err := renderConfigTemplate(`{{ .Unknown }}`, data); err == nil {
+		t.Error("referencing an unknown field must fail")
+	}
+	if _, err := renderConfigTemplate(`{{ .Config `, data); err == nil {
+		t.Error("invalid template must fail")
+	}
+}
+
+func TestTrustedOperators(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	operator, _, _ := issueOperator(t)
+	operator.Namespace = "nats"
+	migrated, _, _ := issueOperator(t)
+	migrated.Namespace = "nats"
+	migrated.Name = "migrated"
+	pending := &natsv1alpha1.NatsOperator{}
+	pending.Namespace = "nats"
+	pending.Name = "pending"
+	nsc, _, _ := issueOperator(t)
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, migrated, pending).Build()
+	r := &NatsOperatorReconciler{Client: k8s, Scheme: scheme}
+
+	operator.Spec.TrustedOperators = []natsv1alpha1.TrustedOperator{{Name: "migrated"}, {JWT: nsc.Status.JWT}, {Name: operator.Name}, {JWT: migrated.Status.JWT}}
+	trusted, invalid, err := r.trustedOperators(context.Background(), operator)
+	if err != nil || invalid != "" {
+		t.Fatal(err, invalid)
+	}
+	if len(trusted) != 2 || trusted[0].Name != "migrated" || trusted[0].PublicKey != migrated.Status.PublicKey || trusted[1].PublicKey != nsc.Status.PublicKey {
+		t.Fatalf("expected the migrated and nsc operators, got %+v", trusted)
+	}
+	config, err := conf.Parse(fmt.Sprintf(AUTH_CONFIG_TEMPLATE, renderOperators(operator.Status.JWT, trusted), "ASYS", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jwts, ok := config["operator"].([]interface{}); !ok || len(jwts) != 3 || jwts[0] != operator.Status.JWT || jwts[2] != nsc.Status.JWT {
+		t.Fatalf("expected a list of all operator jwts, got %v", config["operator"])
+	}
+	if renderOperators(operator.Status.JWT, nil) != operator.Status.JWT {
+		t.Error("a single operator must be rendered as before")
+	}
+
+	for _, refs := range [][]natsv1alpha1.TrustedOperator{{{Name: "missing"}}, {{Name: "pending"}}, {{JWT: "invalid"}}, {{}}, {{Name: "migrated", JWT: nsc.Status.JWT}}} {
+		operator.Spec.TrustedOperators = refs
+		if _, invalid, err := r.trustedOperators(context.Background(), operator); err != nil || invalid == "" {
+			t.Errorf("expected %+v to be reported as invalid, got %v", refs, err)
+		}
+	}
+}
+
+func TestReconcileOperatorClaims(t *testing.T) {
+	r := &NatsOperatorReconciler{Recorder: record.NewFakeRecorder(100)}
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Spec.AccountServerURL = "https://account-server:9090/jwt/v1"
+	operator.Spec.OperatorServiceURLs = jwt.StringList{"tls://nats:4222"}
+	operator.Spec.AssertServerVersion = "2.9.0"
+	operator.Spec.Tags = jwt.TagList{"env:prod"}
+	sysacc, _ := nkeys.CreateAccount()
+	sysaccPublic, _ := sysacc.PublicKey()
+	secret := &corev1.Secret{}
+
+	if changed, err := r.reconcileKey(context.Background(), secret, operator, nil, sysaccPublic); err != nil || !changed {
+		t.Fatalf("expected the operator to be issued, got %v", err)
+	}
+	claims, err := jwt.DecodeOperatorClaims(string(secret.Data[OPERATOR_JWT]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.AccountServerURL != operator.Spec.AccountServerURL || claims.OperatorServiceURLs[0] != "tls://nats:4222" ||
+		claims.SystemAccount != sysaccPublic || claims.AssertServerVersion != "2.9.0" || !claims.Tags.Contains("env:prod") {
+		t.Fatalf("claims not issued from the spec: %+v", claims.Operator)
+	}
+	if changed, err := r.reconcileKey(context.Background(), secret, operator, nil, sysaccPublic); err != nil || changed {
+		t.Fatalf("unchanged claims must not be re-issued, got %v", err)
+	}
+
+	other, _ := nkeys.CreateAccount()
+	operator.Spec.SystemAccount, _ = other.PublicKey()
+	if _, err := r.reconcileKey(context.Background(), secret, operator, nil, sysaccPublic); err == nil {
+		t.Fatal("a system account other than the generated one must be rejected")
+	}
+	operator.Spec.SystemAccount = sysaccPublic
+	if changed, err := r.reconcileKey(context.Background(), secret, operator, nil, sysaccPublic); err != nil || changed {
+		t.Fatalf("pinning the generated system account must not re-issue the operator, got %v", err)
+	}
+	operator.Spec.SystemAccount = ""
+
+	operator.Spec.StrictSigningKeyUsage = true
+	if _, err := r.reconcileKey(context.Background(), secret, operator, nil, sysaccPublic); err == nil {
+		t.Error("strict signing key usage without managed signing keys must be rejected")
+	}
+	operator.Spec.StrictSigningKeyUsage = false
+	operator.Spec.AssertServerVersion = "latest"
+	if _, err := r.reconcileKey(context.Background(), secret, operator, nil, sysaccPublic); err == nil {
+		t.Error("invalid server version must be rejected")
+	}
+}
+
+func TestRenderConfigWithSystemAccount(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	k8s := fake.NewClientBuilder().WithScheme(scheme).Build()
+	r := &NatsOperatorReconciler{Client: k8s, Scheme: scheme, Recorder: record.NewFakeRecorder(100)}
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Namespace = "nats"
+	operator.Name = "operator"
+	secret := &corev1.Secret{}
+	identity, _ := nkeys.CreateOperator()
+	sysacc := issueAccount(t, identity)
+	sysacc.Namespace = "nats"
+	sysacc.Name = "operator-system"
+	operator.Spec.SystemAccount = sysacc.Status.PublicKey
+	if _, err := r.reconcileKey(context.Background(), secret, operator, nil, sysacc.Status.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	operator.Status.JWT = string(secret.Data[OPERATOR_JWT])
+
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(operator)}
+	if _, err := r.reconcileServerConfigSnipped(context.Background(), req, operator, sysacc, []natsv1alpha1.NatsAccount{*sysacc}, false); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &corev1.Secret{}
+	if err := k8s.Get(context.Background(), client.ObjectKey{Namespace: "nats", Name: "operator-server-config"}, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	config, err := conf.Parse(string(serverConfig.Data[OPERATOR_CONFIG_FILE]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := jwt.DecodeOperatorClaims(config["operator"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config["system_account"] != claims.SystemAccount || claims.SystemAccount != sysacc.Status.PublicKey {
+		t.Fatalf("expected system account %v in the config and the operator jwt, got %v and %v", sysacc.Status.PublicKey, config["system_account"], claims.SystemAccount)
+	}
+
+	// An unchanged config isn't written again
+	if _, err := r.reconcileServerConfigSnipped(context.Background(), req, operator, sysacc, []natsv1alpha1.NatsAccount{*sysacc}, true); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := &corev1.Secret{}
+	if err := k8s.Get(context.Background(), client.ObjectKeyFromObject(serverConfig), unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged.ResourceVersion != serverConfig.ResourceVersion {
+		t.Errorf("expected the unchanged config not to be updated, got resource version %v after %v", unchanged.ResourceVersion, serverConfig.ResourceVersion)
+	}
+}
+
+func TestRetireSigningKeyAfterPush(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	operator, _, oldKey := issueOperator(t)
+	operator.Namespace = "nats"
+	oldPublic, _ := oldKey.PublicKey()
+	operator.Spec.ManagedSigningKeys = []natsv1alpha1.OperatorSigningKey{{Name: "new"}}
+	operator.Status.SigningKeys = []natsv1alpha1.OperatorSigningKeyStatus{{Name: "old", SecretName: "operator-sk-old", PublicKey: oldPublic}}
+	oldSecret := &corev1.Secret{}
+	oldSecret.Namespace = "nats"
+	oldSecret.Name = "operator-sk-old"
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(oldSecret).Build()
+	r := &NatsOperatorReconciler{Client: k8s, Scheme: scheme}
+	ctx := context.Background()
+
+	retiring := func(accounts []natsv1alpha1.NatsAccount) bool {
+		signingKeys, err := r.reconcileSigningKeys(ctx, operator, accounts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := lo.Find(signingKeys, func(key natsv1alpha1.OperatorSigningKeyStatus) bool { return key.Name == "old" && key.Retiring })
+		return ok
+	}
+
+	account := issueAccount(t, oldKey)
+	account.Namespace = "nats"
+	setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_PUSHED, true, "Pushed", "")
+	account.Status.Push = &natsv1alpha1.AccountPushStatus{JWTHash: jwtHash(account.Status.JWT)}
+	if !retiring([]natsv1alpha1.NatsAccount{*account}) {
+		t.Fatal("key must be kept while an account is signed by it")
+	}
+
+	// Re-issued with the new key, but not pushed yet
+	newSecret := &corev1.Secret{}
+	if err := k8s.Get(ctx, client.ObjectKey{Namespace: "nats", Name: "operator-operator-sk-new"}, newSecret); err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := nkeys.FromSeed(newSecret.Data[OPERATOR_SEED_KEY])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reissued := issueAccount(t, newKey)
+	account.Status.JWT = reissued.Status.JWT
+	setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_PUSHED, false, "Pending", "account has been re-issued")
+	if !retiring([]natsv1alpha1.NatsAccount{*account}) {
+		t.Fatal("key must be kept until the re-issued account has been pushed")
+	}
+	setCondition(&account.Status.Conditions, account, natsv1alpha1.CONDITION_PUSHED, true, "Pushed", "")
+	if !retiring([]natsv1alpha1.NatsAccount{*account}) {
+		t.Fatal("key must be kept while the push status is of the previous jwt")
+	}
+
+	account.Status.Push = &natsv1alpha1.AccountPushStatus{JWTHash: jwtHash(account.Status.JWT)}
+	if retiring([]natsv1alpha1.NatsAccount{*account}) {
+		t.Fatal("key must be removed once the re-issued account has been pushed")
+	}
+	if err := k8s.Get(ctx, client.ObjectKeyFromObject(oldSecret), &corev1.Secret{}); !errors.IsNotFound(err) {
+		t.Errorf("expected the secret of the retired key to be deleted, got %v", err)
+	}
+}
+
+func TestOfflineRootSystemAccount(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	identity, _ := nkeys.CreateOperator()
+	identityPublic, _ := identity.PublicKey()
+	signingKey, _ := nkeys.CreateOperator()
+	signingPublic, _ := signingKey.PublicKey()
+	signingSeed, _ := signingKey.Seed()
+	sysacc := issueAccount(t, signingKey)
+	sysacc.Namespace = "nats"
+	sysacc.Name = "operator-system"
+	sysacc.Spec.OperatorRef.Name = "operator"
+
+	operator := &natsv1alpha1.NatsOperator{}
+	operator.Namespace = "nats"
+	operator.Name = "operator"
+	operator.Spec.OfflineRoot = &natsv1alpha1.OfflineRoot{SecretName: "offline"}
+	other := operator.DeepCopy()
+	other.Name = "other"
+	other.Spec.OfflineRoot.SecretName = "other"
+	secret := &corev1.Secret{}
+	secret.Namespace = "nats"
+	secret.Name = "offline"
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(operator, other, secret).
+		WithIndex(&natsv1alpha1.NatsOperator{}, OFFLINE_ROOT_INDEX, offlineRootIndex).Build()
+	r := &NatsOperatorReconciler{Client: k8s, Scheme: scheme}
+	ctx := context.Background()
+
+	if requests := r.findOfflineRootOperators(secret); len(requests) != 1 || requests[0].Name != "operator" {
+		t.Fatalf("expected only the operator referencing the secret, got %v", requests)
+	}
+
+	issue := func(systemAccount string) error {
+		claims := jwt.NewOperatorClaims(identityPublic)
+		claims.SigningKeys.Add(signingPublic)
+		claims.SystemAccount = systemAccount
+		token, err := claims.Encode(identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret.Data = map[string][]byte{OPERATOR_JWT: []byte(token), OPERATOR_SEED_KEY: signingSeed}
+		if err := k8s.Update(ctx, secret); err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.reconcileSecret(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(operator)}, operator, nil, []natsv1alpha1.NatsAccount{*sysacc})
+		return err
+	}
+	if err := issue(""); err != nil {
+		t.Errorf("an operator jwt without system account must be accepted: %v", err)
+	}
+	if err := issue(sysacc.Status.PublicKey); err != nil {
+		t.Errorf("an operator jwt naming the generated system account must be accepted: %v", err)
+	}
+	otherAccount, _ := nkeys.CreateAccount()
+	otherPublic, _ := otherAccount.PublicKey()
+	if err := issue(otherPublic); err == nil {
+		t.Error("an operator jwt naming another system account must be rejected")
+	}
+}
@@ -24,16 +24,27 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/utils/strings/slices"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nkeys"
+	"github.com/samber/lo"
 )
 
 const ACCOUNT_TEMPLATE = `-----BEGIN NATS USER JWT-----
@@ -45,10 +56,24 @@ const ACCOUNT_TEMPLATE = `-----BEGIN NATS USER JWT-----
 ------END USER NKEY SEED------
 `
 
+// userSigner describes the key pair a user JWT is signed with
+type userSigner struct {
+	seed []byte
+	// issuerAccount is set if the user is signed by an account signing key
+	issuerAccount string
+	// scoped signing keys provide the permissions and limits, so the user must not carry them
+	scoped bool
+	// validity is the validity of the JWT, JWTs without validity never expire
+	validity time.Duration
+}
+
 // NatsUserReconciler reconciles a NatsUser object
 type NatsUserReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// MaxConcurrentReconciles is the number of users reconciled in parallel, defaults to 1
+	MaxConcurrentReconciles int
 }
 
 //+kubebuilder:rbac:groups=nats.deinstapel.de,resources=natsusers,verbs=get;list;watch;create;update;patch;delete
@@ -76,8 +101,13 @@ func (r *NatsUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	}
 
 	if user.DeletionTimestamp != nil {
-		// TODO: Check if deletion is ok.
 		logger.Info("Processing deletion of user")
+		if controllerutil.ContainsFinalizer(user, JWT_OPERATOR_FINALIZER) && user.Status.PublicKey != "" {
+			// Revoke all JWTs issued to the user, the credentials might still be around
+			if err := r.revokeUser(ctx, user, user.Status.PublicKey, time.Now()); err != nil && !errors.IsNotFound(err) {
+				return ctrl.Result{}, err
+			}
+		}
 		if controllerutil.RemoveFinalizer(user, JWT_OPERATOR_FINALIZER) {
 			if err := r.Update(ctx, user); err != nil {
 				return ctrl.Result{}, err
@@ -92,40 +122,91 @@ func (r *NatsUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		}
 	}
 
+	status := user.Status.DeepCopy()
+	ready, err := r.reconcileUser(ctx, req, user)
+	setReadyCondition(&user.Status.Conditions, user, ready, err)
+	user.Status.ObservedGeneration = user.Generation
+	if !reflect.DeepEqual(status, &user.Status) {
+		if updateErr := r.Status().Update(ctx, user); updateErr != nil && err == nil {
+			err = updateErr
+		}
+	}
+	// Renew the JWT before it expires
+	return ctrl.Result{RequeueAfter: renewalDelay(user.Status.JWT)}, err
+}
+
+// reconcileUser issues the user, the results are written to the status of the user.
+// It returns whether the user is ready.
+func (r *NatsUserReconciler) reconcileUser(ctx context.Context, req ctrl.Request, user *natsv1alpha1.NatsUser) (bool, error) {
+	logger := log.FromContext(ctx)
 	issuingAccount := &natsv1alpha1.NatsAccount{}
 	signerSecret := &corev1.Secret{}
-	for {
-		if err := r.Get(ctx, client.ObjectKey{
-			Namespace: user.Spec.AccountRef.Namespace,
-			Name:      user.Spec.AccountRef.Name,
-		}, issuingAccount); err != nil {
-			// TODO: post event to apiserver
-			return ctrl.Result{}, err
-		}
-		if issuingAccount.Status.AccountSecretName == "" {
-			logger.Info("waiting for issuing account secret to appear")
-			<-time.After(5 * time.Second)
-			continue
+	if err := r.Get(ctx, accountRef(user), issuingAccount); err != nil {
+		if errors.IsNotFound(err) {
+			r.Recorder.Eventf(user, corev1.EventTypeWarning, "AccountNotFound", "Account %v does not exist", accountRef(user))
 		}
+		return false, err
+	}
+	if issuingAccount.Status.AccountSecretName == "" {
+		// The account watch enqueues this user once the account has been issued
+		logger.Info("waiting for issuing account secret to appear")
+		message := fmt.Sprintf("waiting for account %v to be issued", issuingAccount.Name)
+		setCondition(&user.Status.Conditions, user, natsv1alpha1.CONDITION_JWT_ISSUED, false, "WaitingForAccount", message)
+		setCondition(&user.Status.Conditions, user, natsv1alpha1.CONDITION_READY, false, "WaitingForAccount", message)
+		return false, nil
+	}
 
-		if !slices.Contains(issuingAccount.Spec.AllowUserNamespaces, req.Namespace) {
-			// TODO: post event to apiserver
-			return ctrl.Result{}, nil
-		}
+	if !slices.Contains(issuingAccount.Spec.AllowUserNamespaces, req.Namespace) {
+		message := fmt.Sprintf("account %v does not allow users in namespace %v", issuingAccount.Name, req.Namespace)
+		r.Recorder.Event(user, corev1.EventTypeWarning, "NamespaceNotAllowed", message)
+		setCondition(&user.Status.Conditions, user, natsv1alpha1.CONDITION_NAMESPACE_ALLOWED, false, "NamespaceNotAllowed", message)
+		setCondition(&user.Status.Conditions, user, natsv1alpha1.CONDITION_READY, false, "NamespaceNotAllowed", message)
+		return false, nil
+	}
+	setCondition(&user.Status.Conditions, user, natsv1alpha1.CONDITION_NAMESPACE_ALLOWED, true, "NamespaceAllowed", "")
 
-		if err := r.Get(ctx, client.ObjectKey{
-			Namespace: issuingAccount.Namespace,
-			Name:      issuingAccount.Status.AccountSecretName,
-		}, signerSecret); err != nil {
-			return ctrl.Result{}, err
+	signerSecretName := issuingAccount.Status.AccountSecretName
+	if user.Spec.SigningKeyRole != "" {
+		signingKey, ok := lo.Find(issuingAccount.Status.SigningKeys, func(k natsv1alpha1.AccountSigningKeyStatus) bool {
+			return k.Role == user.Spec.SigningKeyRole
+		})
+		if !ok {
+			err := fmt.Errorf("account %v has no signing key for role %v", issuingAccount.Name, user.Spec.SigningKeyRole)
+			r.Recorder.Event(user, corev1.EventTypeWarning, "SignerNotFound", errorMessage(err))
+			setCondition(&user.Status.Conditions, user, natsv1alpha1.CONDITION_JWT_ISSUED, false, "SigningKeyNotFound", errorMessage(err))
+			return false, err
 		}
-		break
+		signerSecretName = signingKey.SecretName
 	}
 
-	_, err := r.reconcileSecret(ctx, req, user, signerSecret)
-	return ctrl.Result{}, err
+	if err := r.Get(ctx, client.ObjectKey{
+		Namespace: issuingAccount.Namespace,
+		Name:      signerSecretName,
+	}, signerSecret); err != nil {
+		r.Recorder.Eventf(user, corev1.EventTypeWarning, "SignerNotFound", "Failed to get signing key %v of account %v: %v", signerSecretName, issuingAccount.Name, errorMessage(err))
+		return false, err
+	}
+
+	signer := userSigner{seed: signerSecret.Data[OPERATOR_SEED_KEY]}
+	if issuingAccount.Spec.UserJWTValidity != nil {
+		signer.validity = issuingAccount.Spec.UserJWTValidity.Duration
+	}
+	if user.Spec.SigningKeyRole != "" {
+		signer.issuerAccount = issuingAccount.Status.PublicKey
+		signer.scoped = lo.ContainsBy(issuingAccount.Spec.SigningKeys, func(k natsv1alpha1.AccountSigningKey) bool {
+			return k.Role == user.Spec.SigningKeyRole && k.Template != nil
+		})
+	}
+
+	if _, err := r.reconcileSecret(ctx, req, user, signer); err != nil {
+		return false, err
+	}
+	setCondition(&user.Status.Conditions, user, natsv1alpha1.CONDITION_KEYS_READY, true, "KeysGenerated", "")
+	setCondition(&user.Status.Conditions, user, natsv1alpha1.CONDITION_JWT_ISSUED, true, "Issued", fmt.Sprintf("issued by account %v", issuingAccount.Name))
+	return true, nil
 }
-func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, user *natsv1alpha1.NatsUser, signerSecret *corev1.Secret) (*corev1.Secret, error) {
+
+func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Request, user *natsv1alpha1.NatsUser, signer userSigner) (*corev1.Secret, error) {
 	// Try reconcile the secret containing the seed key for the operator
 	logger := log.FromContext(ctx)
 	keySecret := &corev1.Secret{}
@@ -144,10 +225,16 @@ func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Reque
 	}
 
 	logger.Info("reconciling user keys")
-	hasChanges, err := r.reconcileKey(ctx, keySecret, user, signerSecret.Data[OPERATOR_SEED_KEY])
+	hasChanges, err := r.reconcileKey(ctx, keySecret, user, signer)
 	if err != nil {
 		return nil, err
 	}
+	if !hasSecret || hasChanges {
+		// Revoke before storing the new JWT, so a failed revocation is retried with the next attempt
+		if err := r.revokePrevious(ctx, user, keySecret); err != nil {
+			return nil, err
+		}
+	}
 
 	if !hasSecret {
 		if err := r.Create(ctx, keySecret); err != nil {
@@ -160,18 +247,15 @@ func (r *NatsUserReconciler) reconcileSecret(ctx context.Context, req ctrl.Reque
 	}
 
 	if !hasSecret || hasChanges {
-		// Update operator status if we encountered changes
-		user.Status.UserSecretName = keySecret.Name
-		user.Status.PublicKey = string(keySecret.Data[OPERATOR_PUBLIC_KEY])
-		user.Status.JWT = string(keySecret.Data[OPERATOR_JWT])
-		if err := r.Status().Update(ctx, user); err != nil {
-			return nil, err
-		}
+		user.Status.LastIssued = &metav1.Time{Time: time.Now()}
 	}
+	user.Status.UserSecretName = keySecret.Name
+	user.Status.PublicKey = string(keySecret.Data[OPERATOR_PUBLIC_KEY])
+	user.Status.JWT = string(keySecret.Data[OPERATOR_JWT])
 	return keySecret, nil
 }
 
-func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, account *natsv1alpha1.NatsUser, signer []byte) (bool, error) {
+func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Secret, account *natsv1alpha1.NatsUser, signer userSigner) (bool, error) {
 	logger := log.FromContext(ctx)
 	keys, needsKeyUpdate, err := extractOrCreateKeys(secret, nkeys.CreateUser)
 	if err != nil {
@@ -182,19 +266,39 @@ func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Se
 	public, _ := keys.PublicKey()
 
 	token := jwt.NewUserClaims(public)
-	token.User = account.Spec.ToNatsJWT()
+	if signer.scoped {
+		// Permissions and limits are inherited from the scoped signing key
+		token.User = jwt.User{}
+	} else {
+		token.User = account.Spec.ToNatsJWT()
+	}
+	token.IssuerAccount = signer.issuerAccount
+	now := time.Now()
+	if signer.validity > 0 {
+		token.Expires = now.Add(signer.validity).Unix()
+	}
 	needsClaimsUpdate := secret.Data == nil
-	signerKp, err := nkeys.FromSeed(signer)
+	signerKp, err := nkeys.FromSeed(signer.seed)
 	if err != nil {
-		return false, fmt.Errorf("failed decoding seed: %v, signer: %v", err, signer)
+		return false, fmt.Errorf("failed decoding seed: %v", err)
 	}
+	signerPublic, _ := signerKp.PublicKey()
 
+	var changes []string
 	if secret.Data != nil {
 		oldToken, err := jwt.DecodeUserClaims(string(secret.Data[OPERATOR_JWT]))
 		if err == nil {
-			needsClaimsUpdate = needsClaimsUpdate || !reflect.DeepEqual(token.User, oldToken.User)
+			// Type and version are only populated while encoding
+			oldToken.User.GenericFields = token.User.GenericFields
+			changes = changedFields(oldToken.User, token.User)
 			// Check if the signing keys changed
-			needsClaimsUpdate = needsClaimsUpdate || oldToken.Issuer != token.Issuer
+			if oldToken.Issuer != signerPublic {
+				changes = append(changes, "issuer")
+			}
+			if needsRenewal(oldToken.ClaimsData, signer.validity, now) {
+				changes = append(changes, "exp")
+			}
+			needsClaimsUpdate = needsClaimsUpdate || len(changes) > 0
 		} else {
 			// Claims could not be decoded, need update.
 			needsClaimsUpdate = true
@@ -218,13 +322,125 @@ func (r *NatsUserReconciler) reconcileKey(ctx context.Context, secret *corev1.Se
 		}
 		secret.Data[OPERATOR_JWT] = []byte(jwt)
 		secret.Data[OPERATOR_CREDS] = []byte(fmt.Sprintf(ACCOUNT_TEMPLATE, jwt, seed))
+		recordIssued(r.Recorder, account, public, needsKeyUpdate, changes)
 	}
 	return needsKeyUpdate || needsClaimsUpdate, nil
 }
 
+// revokePrevious revokes the JWTs issued to the user before the JWT in keySecret.
+func (r *NatsUserReconciler) revokePrevious(ctx context.Context, user *natsv1alpha1.NatsUser, keySecret *corev1.Secret) error {
+	if user.Status.JWT == "" {
+		// Never issued before
+		return nil
+	}
+	public := string(keySecret.Data[OPERATOR_PUBLIC_KEY])
+	if user.Status.PublicKey != public {
+		// The key pair has been replaced, none of the JWTs of the old key are valid anymore
+		return r.revokeUser(ctx, user, user.Status.PublicKey, time.Now())
+	}
+	claims, err := jwt.DecodeUserClaims(string(keySecret.Data[OPERATOR_JWT]))
+	if err != nil {
+		return err
+	}
+	return r.revokeUser(ctx, user, public, time.Unix(claims.IssuedAt-1, 0))
+}
+
+// renewAt returns the time a user JWT is re-issued, after two thirds of its validity. It's the zero time for JWTs
+// that never expire.
+func renewAt(claims jwt.ClaimsData) time.Time {
+	if claims.Expires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Expires-(claims.Expires-claims.IssuedAt)/3, 0)
+}
+
+// needsRenewal reports whether a user JWT has to be re-issued to match the validity configured by its account.
+func needsRenewal(claims jwt.ClaimsData, validity time.Duration, now time.Time) bool {
+	if validity <= 0 {
+		return claims.Expires != 0
+	}
+	return claims.Expires == 0 || claims.Expires > now.Add(validity).Unix() || !now.Before(renewAt(claims))
+}
+
+// renewalDelay returns the time until the user JWT token is re-issued, zero if it never expires.
+func renewalDelay(token string) time.Duration {
+	claims, err := jwt.DecodeUserClaims(token)
+	if err != nil || claims.Expires == 0 {
+		return 0
+	}
+	return lo.Max([]time.Duration{time.Until(renewAt(claims.ClaimsData)), time.Second})
+}
+
+// revokeUser adds publicKey to the revocations in the secret of the account of the user, all JWTs of the key
+// issued up to the given time are rejected once the account has been re-issued. The revocation is pruned once the
+// account key that signed the current JWT of the user is gone or the JWT expired.
+func (r *NatsUserReconciler) revokeUser(ctx context.Context, user *natsv1alpha1.NatsUser, publicKey string, at time.Time) error {
+	issuer := ""
+	var expires int64
+	if claims, err := jwt.DecodeUserClaims(user.Status.JWT); err == nil {
+		issuer = claims.Issuer
+		expires = claims.Expires
+	}
+	revoked := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		account := &natsv1alpha1.NatsAccount{}
+		if err := r.Get(ctx, accountRef(user), account); err != nil {
+			return err
+		}
+		if account.Status.AccountSecretName == "" {
+			// Never issued, so there are no JWTs to revoke
+			return nil
+		}
+		accountSecret := &corev1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: account.Namespace, Name: account.Status.AccountSecretName}, accountSecret); err != nil {
+			return err
+		}
+		revocations, err := readRevocations(accountSecret, account)
+		if err != nil {
+			return err
+		}
+		revocations.revoke(publicKey, at, issuer, expires)
+		if revoked, err = writeRevocations(accountSecret, revocations); err != nil || !revoked {
+			return err
+		}
+		return r.Update(ctx, accountSecret)
+	})
+	if err != nil || !revoked {
+		return err
+	}
+	r.Recorder.Eventf(user, corev1.EventTypeNormal, "Revoked", "Revoked JWTs of %v issued up to %v", publicKey, at.UTC().Format(time.RFC3339))
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *NatsUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&natsv1alpha1.NatsUser{}).
+		// Secrets are not controller owned, so we can't use Owns here
+		Watches(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestForOwner{OwnerType: &natsv1alpha1.NatsUser{}}).
+		Watches(&source.Kind{Type: &natsv1alpha1.NatsAccount{}}, handler.EnqueueRequestsFromMapFunc(r.findIssuedUsers), builder.WithPredicates(predicate.Funcs{
+			UpdateFunc: func(e event.UpdateEvent) bool {
+				// Users need to be re-issued whenever the keys of the account change
+				oldAccount, newAccount := e.ObjectOld.(*natsv1alpha1.NatsAccount), e.ObjectNew.(*natsv1alpha1.NatsAccount)
+				return oldAccount.Status.PublicKey != newAccount.Status.PublicKey ||
+					oldAccount.Status.AccountSecretName != newAccount.Status.AccountSecretName ||
+					!reflect.DeepEqual(oldAccount.Status.SigningKeys, newAccount.Status.SigningKeys) ||
+					!reflect.DeepEqual(oldAccount.Spec.SigningKeys, newAccount.Spec.SigningKeys) ||
+					!reflect.DeepEqual(oldAccount.Spec.AllowUserNamespaces, newAccount.Spec.AllowUserNamespaces) ||
+					!reflect.DeepEqual(oldAccount.Spec.UserJWTValidity, newAccount.Spec.UserJWTValidity)
+			},
+		})).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
+
+// findIssuedUsers enqueues all users issued by the given account.
+func (r *NatsUserReconciler) findIssuedUsers(obj client.Object) []reconcile.Request {
+	users := &natsv1alpha1.NatsUserList{}
+	if err := r.List(context.Background(), users, client.MatchingFields{ACCOUNT_REF_INDEX: indexKey(client.ObjectKeyFromObject(obj))}); err != nil {
+		return nil
+	}
+	return lo.Map(users.Items, func(user natsv1alpha1.NatsUser, _ int) reconcile.Request {
+		return reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&user)}
+	})
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// issueRoleAccount issues an account with a scoped signing key for the role "scoped" and a plain one for the role
+// "plain", the secrets contain the seeds of the account and its signing keys.
+func issueRoleAccount(t *testing.T) (*natsv1alpha1.NatsAccount, []client.Object) {
+	account := &natsv1alpha1.NatsAccount{}
+	account.Namespace = "nats"
+	account.Name = "account"
+	account.Spec.AllowUserNamespaces = []string{"apps"}
+	account.Spec.SigningKeys = []natsv1alpha1.AccountSigningKey{
+		{Role: "scoped", Template: &natsv1alpha1.UserPermissionLimits{
+			Permissions: natsv1alpha1.Permissions{Pub: natsv1alpha1.Permission{Allow: jwt.StringList{"scoped.>"}}},
+		}},
+		{Role: "plain"},
+	}
+	secrets := []client.Object{}
+	addSecret := func(name string, keys nkeys.KeyPair) string {
+		seed, _ := keys.Seed()
+		public, _ := keys.PublicKey()
+		secret := &corev1.Secret{}
+		secret.Namespace = "nats"
+		secret.Name = name
+		secret.Data = map[string][]byte{OPERATOR_SEED_KEY: seed, OPERATOR_PUBLIC_KEY: []byte(public)}
+		secrets = append(secrets, secret)
+		return public
+	}
+	accountKeys, _ := nkeys.CreateAccount()
+	account.Status.AccountSecretName = "account"
+	account.Status.PublicKey = addSecret("account", accountKeys)
+	for _, role := range []string{"scoped", "plain"} {
+		keys, _ := nkeys.CreateAccount()
+		name := "account-account-sk-" + role
+		account.Status.SigningKeys = append(account.Status.SigningKeys, natsv1alpha1.AccountSigningKeyStatus{
+			Role: role, SecretName: name, PublicKey: addSecret(name, keys),
+		})
+	}
+	return account, secrets
+}
+
+func TestAccountSigningKeys(t *testing.T) {
+	account, _ := issueRoleAccount(t)
+	scoped, plain := account.Status.SigningKeys[0], account.Status.SigningKeys[1]
+	stale, _ := nkeys.CreateAccount()
+	stalePublic, _ := stale.PublicKey()
+	// Keys of roles removed from the spec are left out
+	signingKeys := append(account.Status.SigningKeys, natsv1alpha1.AccountSigningKeyStatus{Role: "removed", PublicKey: stalePublic})
+
+	claims := jwt.NewAccountClaims(account.Status.PublicKey)
+	claims.Account = account.Spec.ToJWTAccount(signingKeys, nil)
+	if len(claims.SigningKeys) != 2 || claims.SigningKeys.Contains(stalePublic) {
+		t.Fatalf("expected the signing keys of the spec, got %v", claims.SigningKeys.Keys())
+	}
+	if scope, ok := claims.SigningKeys.GetScope(plain.PublicKey); !ok || scope != nil {
+		t.Errorf("expected the signing key without a template to be unscoped, got %v", scope)
+	}
+	scope, ok := claims.SigningKeys.GetScope(scoped.PublicKey)
+	userScope, isUserScope := scope.(*jwt.UserScope)
+	if !ok || !isUserScope {
+		t.Fatalf("expected the signing key with a template to be scoped, got %v", scope)
+	}
+	if userScope.Key != scoped.PublicKey || userScope.Role != "scoped" {
+		t.Errorf("expected the scope of role scoped, got key %v role %v", userScope.Key, userScope.Role)
+	}
+	if allow := userScope.Template.Pub.Allow; len(allow) != 1 || allow[0] != "scoped.>" {
+		t.Errorf("expected the permissions of the template, got %v", allow)
+	}
+	if limits := userScope.Template.NatsLimits; limits.Subs != jwt.NoLimit || limits.Data != jwt.NoLimit || limits.Payload != jwt.NoLimit {
+		t.Errorf("expected unset limits of the template to be unlimited, got %+v", limits)
+	}
+
+	// The decoded signing keys compare equal, so the account isn't re-issued on every reconcile
+	operatorKeys, _ := nkeys.CreateOperator()
+	token, err := claims.Encode(operatorKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jwt.DecodeAccountClaims(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.SigningKeys, claims.SigningKeys) {
+		t.Errorf("expected the decoded signing keys to be unchanged, got %v", decoded.SigningKeys)
+	}
+}
+
+func TestUserSignedByRole(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	account, secrets := issueRoleAccount(t)
+	claims := jwt.NewAccountClaims(account.Status.PublicKey)
+	claims.Account = account.Spec.ToJWTAccount(account.Status.SigningKeys, nil)
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(secrets, account)...).Build()
+	r := &NatsUserReconciler{Client: k8s, Scheme: scheme, Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+
+	issue := func(name string, role string) (*jwt.UserClaims, error) {
+		user := &natsv1alpha1.NatsUser{}
+		user.Namespace = "apps"
+		user.Name = name
+		user.Spec.AccountRef.Namespace = "nats"
+		user.Spec.AccountRef.Name = "account"
+		user.Spec.SigningKeyRole = role
+		user.Spec.Permissions.Sub.Allow = jwt.StringList{"user.>"}
+		if err := k8s.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(user)}); err != nil {
+			return nil, err
+		}
+		if err := k8s.Get(ctx, client.ObjectKeyFromObject(user), user); err != nil {
+			t.Fatal(err)
+		}
+		userClaims, err := jwt.DecodeUserClaims(user.Status.JWT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return userClaims, nil
+	}
+
+	// Scoped users carry no permissions and are accepted by the scope of the role
+	scoped, err := issue("scoped", "scoped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scoped.Issuer != account.Status.SigningKeys[0].PublicKey || scoped.IssuerAccount != account.Status.PublicKey {
+		t.Errorf("expected the user to be issued by the scoped key for the account, got %v for %v", scoped.Issuer, scoped.IssuerAccount)
+	}
+	scope, _ := claims.SigningKeys.GetScope(scoped.Issuer)
+	if scope == nil {
+		t.Fatal("expected the issuer to be a scoped signing key of the account")
+	}
+	if err := scope.ValidateScopedSigner(scoped); err != nil {
+		t.Errorf("expected the scoped user to be valid: %v", err)
+	}
+
+	// Users of plain signing keys carry their own permissions
+	plain, err := issue("plain", "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Issuer != account.Status.SigningKeys[1].PublicKey || plain.IssuerAccount != account.Status.PublicKey {
+		t.Errorf("expected the user to be issued by the plain key for the account, got %v for %v", plain.Issuer, plain.IssuerAccount)
+	}
+	if allow := plain.Sub.Allow; len(allow) != 1 || allow[0] != "user.>" {
+		t.Errorf("expected the permissions of the user, got %v", allow)
+	}
+
+	// Users without a role are issued by the account itself
+	direct, err := issue("direct", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if direct.Issuer != account.Status.PublicKey || direct.IssuerAccount != "" {
+		t.Errorf("expected the user to be issued by the account, got %v for %v", direct.Issuer, direct.IssuerAccount)
+	}
+
+	if _, err := issue("unknown", "unknown"); err == nil {
+		t.Error("expected an error for a role the account has no signing key for")
+	}
+}
+
+func TestUserJWTValidity(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	account, secrets := issueRoleAccount(t)
+	account.Spec.UserJWTValidity = &metav1.Duration{Duration: time.Hour}
+	user := &natsv1alpha1.NatsUser{}
+	user.Namespace = "apps"
+	user.Name = "user"
+	user.Spec.AccountRef.Namespace = "nats"
+	user.Spec.AccountRef.Name = "account"
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(secrets, account, user)...).Build()
+	r := &NatsUserReconciler{Client: k8s, Scheme: scheme, Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(user)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k8s.Get(ctx, client.ObjectKeyFromObject(user), user); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := jwt.DecodeUserClaims(user.Status.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Expires != claims.IssuedAt+int64(time.Hour.Seconds()) {
+		t.Errorf("expected the JWT to expire after an hour, got %v", claims.Expires-claims.IssuedAt)
+	}
+	if result.RequeueAfter < 39*time.Minute || result.RequeueAfter > 40*time.Minute {
+		t.Errorf("expected the user to be renewed after two thirds of the validity, got %v", result.RequeueAfter)
+	}
+
+	now := time.Unix(claims.IssuedAt, 0)
+	for _, test := range []struct {
+		name     string
+		validity time.Duration
+		now      time.Time
+		expected bool
+	}{
+		{"valid", time.Hour, now.Add(39 * time.Minute), false},
+		{"renewal due", time.Hour, now.Add(40 * time.Minute), true},
+		{"validity shortened", time.Minute, now, true},
+		{"validity removed", 0, now, true},
+	} {
+		if needsRenewal(claims.ClaimsData, test.validity, test.now) != test.expected {
+			t.Errorf("%v: expected needsRenewal to be %v", test.name, test.expected)
+		}
+	}
+	if !needsRenewal(jwt.ClaimsData{IssuedAt: claims.IssuedAt}, time.Hour, now) {
+		t.Error("expected JWTs without expiry to be renewed once a validity is set")
+	}
+}
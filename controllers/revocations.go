@@ -0,0 +1,115 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/samber/lo"
+	corev1 "k8s.io/api/core/v1"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// ACCOUNT_REVOCATIONS is the key of the user revocations in the secret of an account
+const ACCOUNT_REVOCATIONS = "revocations.json"
+
+// userRevocation revokes all JWTs of a user key issued up to At. Issuers are the keys of the account the revoked
+// JWTs have been signed with, Expires is the time the last of the revoked JWTs expires. Revocations without issuers
+// or expiry are only pruned by the other one.
+type userRevocation struct {
+	At      int64    `json:"at"`
+	Issuers []string `json:"issuers,omitempty"`
+	Expires int64    `json:"expires,omitempty"`
+}
+
+// userRevocations are the revocations of an account by user key, stored in the secret of the account so they
+// survive the loss of its status.
+type userRevocations map[string]userRevocation
+
+// readRevocations decodes the revocations stored in the secret of an account. Secrets without revocations start
+// with the revocations kept in the status of the account before, their issuers are unknown.
+func readRevocations(secret *corev1.Secret, account *natsv1alpha1.NatsAccount) (userRevocations, error) {
+	revocations := userRevocations{}
+	data, ok := secret.Data[ACCOUNT_REVOCATIONS]
+	if !ok {
+		for publicKey, at := range account.Status.Revocations {
+			revocations.revoke(publicKey, time.Unix(at, 0), "", 0)
+		}
+		return revocations, nil
+	}
+	if err := json.Unmarshal(data, &revocations); err != nil {
+		return nil, fmt.Errorf("failed decoding revocations: %v", err)
+	}
+	return revocations, nil
+}
+
+// writeRevocations stores the revocations in the secret of an account, it reports whether they changed.
+func writeRevocations(secret *corev1.Secret, revocations userRevocations) (bool, error) {
+	data, err := json.Marshal(revocations)
+	if err != nil {
+		return false, err
+	}
+	if previous, ok := secret.Data[ACCOUNT_REVOCATIONS]; ok && string(previous) == string(data) {
+		return false, nil
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[ACCOUNT_REVOCATIONS] = data
+	return true, nil
+}
+
+// revoke revokes the JWTs of publicKey issued up to at, which have been signed by issuer and expire at expires.
+// An empty issuer or zero expiry is unknown or never, so the revocation isn't pruned by it.
+func (r userRevocations) revoke(publicKey string, at time.Time, issuer string, expires int64) {
+	revocation, exists := r[publicKey]
+	revocation.At = lo.Max([]int64{revocation.At, at.Unix()})
+	if issuer == "" || exists && len(revocation.Issuers) == 0 {
+		revocation.Issuers = nil
+	} else if !lo.Contains(revocation.Issuers, issuer) {
+		revocation.Issuers = append(revocation.Issuers, issuer)
+	}
+	if expires == 0 || exists && revocation.Expires == 0 {
+		revocation.Expires = 0
+	} else {
+		revocation.Expires = lo.Max([]int64{revocation.Expires, expires})
+	}
+	r[publicKey] = revocation
+}
+
+// prune drops the revocations of JWTs that expired before now or are only signed by keys the account doesn't have
+// anymore, as the NATS servers reject those JWTs anyways.
+func (r userRevocations) prune(accountKeys []string, now time.Time) {
+	for publicKey, revocation := range r {
+		expired := revocation.Expires != 0 && revocation.Expires <= now.Unix()
+		if expired || len(revocation.Issuers) > 0 && !lo.Some(revocation.Issuers, accountKeys) {
+			delete(r, publicKey)
+		}
+	}
+}
+
+// list returns the revocations as listed in the account JWT.
+func (r userRevocations) list() jwt.RevocationList {
+	if len(r) == 0 {
+		return nil
+	}
+	return lo.MapValues(r, func(revocation userRevocation, _ string) int64 { return revocation.At })
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+func TestRevokeUser(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := natsv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	accountKey, _ := nkeys.CreateAccount()
+	accountPublic, _ := accountKey.PublicKey()
+	account := &natsv1alpha1.NatsAccount{}
+	account.Namespace = "nats"
+	account.Name = "account"
+	// Revoked before revocations have been kept in the secret
+	account.Status.Revocations = jwt.RevocationList{"ULEGACY": 100}
+	accountSecret := &corev1.Secret{}
+	accountSecret.Namespace = "nats"
+	accountSecret.Name = "account-keys"
+	account.Status.AccountSecretName = accountSecret.Name
+	userKey, _ := nkeys.CreateUser()
+	userPublic, _ := userKey.PublicKey()
+	userClaims := jwt.NewUserClaims(userPublic)
+	userClaims.Expires = 300
+	userJWT, err := userClaims.Encode(accountKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &natsv1alpha1.NatsUser{}
+	user.Namespace = "apps"
+	user.Spec.AccountRef.Namespace = "nats"
+	user.Spec.AccountRef.Name = "account"
+	user.Status.PublicKey = userPublic
+	user.Status.JWT = userJWT
+	k8s := fake.NewClientBuilder().WithScheme(scheme).WithObjects(account, accountSecret).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &NatsUserReconciler{Client: k8s, Scheme: scheme, Recorder: recorder}
+	ctx := context.Background()
+
+	revoked := time.Unix(200, 0)
+	if err := r.revokeUser(ctx, user, userPublic, revoked); err != nil {
+		t.Fatal(err)
+	}
+	// Revocations of older JWTs are covered already
+	if err := r.revokeUser(ctx, user, userPublic, revoked.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected a single revoked event, got %v", len(recorder.Events))
+	}
+	if err := k8s.Get(ctx, client.ObjectKeyFromObject(accountSecret), accountSecret); err != nil {
+		t.Fatal(err)
+	}
+	revocations, err := readRevocations(accountSecret, &natsv1alpha1.NatsAccount{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revocations["ULEGACY"].At != 100 || len(revocations["ULEGACY"].Issuers) != 0 {
+		t.Errorf("expected the revocation of the status to be kept without issuers, got %+v", revocations["ULEGACY"])
+	}
+	if revocation := revocations[userPublic]; revocation.At != 200 || len(revocation.Issuers) != 1 || revocation.Issuers[0] != accountPublic || revocation.Expires != 300 {
+		t.Errorf("expected the user to be revoked up to 200 issued by the account until 300, got %+v", revocation)
+	}
+}
+
+func TestAccountRevocations(t *testing.T) {
+	r := &NatsAccountReconciler{Recorder: record.NewFakeRecorder(100)}
+	ctx := context.Background()
+	operatorKey, _ := nkeys.CreateOperator()
+	operatorSeed, _ := operatorKey.Seed()
+	roleKey, _ := nkeys.CreateAccount()
+	rolePublic, _ := roleKey.PublicKey()
+	signingKeys := []natsv1alpha1.AccountSigningKeyStatus{{Role: "role", SecretName: "account-sk-role", PublicKey: rolePublic}}
+	account := &natsv1alpha1.NatsAccount{}
+	account.Name = "account"
+	secret := &corev1.Secret{}
+	if _, err := r.reconcileKey(ctx, secret, account, operatorSeed, signingKeys); err != nil {
+		t.Fatal(err)
+	}
+	accountPublic := string(secret.Data[OPERATOR_PUBLIC_KEY])
+
+	revocations := userRevocations{}
+	revocations.revoke("UROLE", time.Unix(100, 0), rolePublic, 0)
+	revocations.revoke("UACCOUNT", time.Unix(100, 0), accountPublic, time.Now().Add(time.Hour).Unix())
+	revocations.revoke("UUNKNOWN", time.Unix(100, 0), "", 0)
+	// The revoked JWTs expired, so the revocation is pruned right away
+	revocations.revoke("UEXPIRED", time.Unix(100, 0), accountPublic, 200)
+	if _, err := writeRevocations(secret, revocations); err != nil {
+		t.Fatal(err)
+	}
+	revokedInJWT := func() jwt.RevocationList {
+		claims, err := jwt.DecodeAccountClaims(string(secret.Data[OPERATOR_JWT]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return claims.Revocations
+	}
+
+	// The revocations survive the loss of the status
+	account.Status = natsv1alpha1.NatsAccountStatus{}
+	if changed, err := r.reconcileKey(ctx, secret, account, operatorSeed, signingKeys); err != nil || !changed {
+		t.Fatalf("expected the account to be re-issued with the revocations, got %v", err)
+	}
+	if revoked := revokedInJWT(); len(revoked) != 3 || len(account.Status.Revocations) != 3 {
+		t.Fatalf("expected all revocations in the jwt and the status, got %v", revoked)
+	}
+
+	// Dropping the signing key prunes the revocations of the JWTs it signed
+	if _, err := r.reconcileKey(ctx, secret, account, operatorSeed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if revoked := revokedInJWT(); len(revoked) != 2 || revoked["UROLE"] != 0 {
+		t.Errorf("expected the revocation of the role to be pruned, got %v", revoked)
+	}
+	stored, err := readRevocations(secret, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stored["UROLE"]; ok || len(stored) != 2 {
+		t.Errorf("expected the revocation of the role to be removed from the secret, got %v", stored)
+	}
+
+	// A new key pair invalidates all JWTs of users
+	delete(secret.Data, OPERATOR_SEED_KEY)
+	if _, err := r.reconcileKey(ctx, secret, account, operatorSeed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if revoked := revokedInJWT(); len(revoked) != 0 {
+		t.Errorf("expected no revocations for a new key pair, got %v", revoked)
+	}
+}
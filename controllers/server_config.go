@@ -0,0 +1,213 @@
+/*
+Copyright 2023.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/samber/lo"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	natsv1alpha1 "github.com/deinstapel/nats-jwt-operator/api/v1alpha1"
+)
+
+// CONFIG_TEMPLATE_KEY is the default key of the server configuration template in its ConfigMap
+const CONFIG_TEMPLATE_KEY = "auth.conf.tmpl"
+
+// CONFIG_TEMPLATE_LABEL must be set to "true" on ConfigMaps with server configuration templates, the operator
+// only caches ConfigMaps with this label
+const CONFIG_TEMPLATE_LABEL = "nats.deinstapel.de/config-template"
+
+// ServerConfigData is the data model the server configuration template is rendered with.
+type ServerConfigData struct {
+	// Config is the default configuration snippet, containing the operator, the system account and the resolver
+	Config string
+	// Resolver is the resolver configuration, including resolver_preload
+	Resolver string
+	Operator ServerConfigOperator
+	// TrustedOperators are the operators trusted next to the operator, Name and Namespace are only set for NatsOperators
+	TrustedOperators []ServerConfigOperator
+	// SystemAccount is the system account of the operator, it's listed in Accounts as well
+	SystemAccount ServerConfigAccount
+	// Accounts are all accounts of the operator, sorted by namespace and name
+	Accounts []ServerConfigAccount
+	// Users are all users of the accounts of the operator, sorted by namespace and name
+	Users []ServerConfigUser
+}
+
+// ServerConfigOperator describes the operator in the server configuration template.
+type ServerConfigOperator struct {
+	Name      string
+	Namespace string
+	PublicKey string
+	JWT       string
+	// SigningKeys are the public keys of all signing keys in the operator JWT
+	SigningKeys []string
+}
+
+// ServerConfigAccount describes an account in the server configuration template.
+type ServerConfigAccount struct {
+	Name      string
+	Namespace string
+	PublicKey string
+	JWT       string
+	Ready     bool
+}
+
+// ServerConfigUser describes a user in the server configuration template.
+type ServerConfigUser struct {
+	Name      string
+	Namespace string
+	// Account is the name of the account of the user, it's in the namespace of the operator
+	Account   string
+	PublicKey string
+	JWT       string
+	// SecretName is the name of the secret with the user.creds of the user, in the namespace of the user
+	SecretName string
+	Ready      bool
+}
+
+// serverConfigData collects the data model of the server configuration template. Accounts and users being
+// deleted are left out.
+func (r *NatsOperatorReconciler) serverConfigData(ctx context.Context, operator *natsv1alpha1.NatsOperator, trusted []ServerConfigOperator, sysacc *natsv1alpha1.NatsAccount, accounts []natsv1alpha1.NatsAccount, resolver string, config string) (*ServerConfigData, error) {
+	data := &ServerConfigData{
+		Config:           config,
+		Resolver:         resolver,
+		Operator:         ServerConfigOperator{Name: operator.Name, Namespace: operator.Namespace, PublicKey: operator.Status.PublicKey, JWT: operator.Status.JWT},
+		TrustedOperators: trusted,
+		SystemAccount:    serverConfigAccount(sysacc),
+		Accounts:         []ServerConfigAccount{},
+		Users:            []ServerConfigUser{},
+	}
+	if claims, err := jwt.DecodeOperatorClaims(operator.Status.JWT); err == nil {
+		data.Operator.SigningKeys = claims.SigningKeys
+	}
+	for i := range accounts {
+		account := &accounts[i]
+		if account.DeletionTimestamp != nil {
+			continue
+		}
+		data.Accounts = append(data.Accounts, serverConfigAccount(account))
+		users := &natsv1alpha1.NatsUserList{}
+		if err := r.List(ctx, users, client.MatchingFields{ACCOUNT_REF_INDEX: indexKey(client.ObjectKeyFromObject(account))}); err != nil {
+			return nil, err
+		}
+		for _, user := range users.Items {
+			if user.DeletionTimestamp != nil {
+				continue
+			}
+			data.Users = append(data.Users, ServerConfigUser{
+				Name:       user.Name,
+				Namespace:  user.Namespace,
+				Account:    account.Name,
+				PublicKey:  user.Status.PublicKey,
+				JWT:        user.Status.JWT,
+				SecretName: user.Status.UserSecretName,
+				Ready:      meta.IsStatusConditionTrue(user.Status.Conditions, natsv1alpha1.CONDITION_READY),
+			})
+		}
+	}
+	sort.Slice(data.Accounts, func(i, j int) bool {
+		return data.Accounts[i].Namespace+"/"+data.Accounts[i].Name < data.Accounts[j].Namespace+"/"+data.Accounts[j].Name
+	})
+	sort.Slice(data.Users, func(i, j int) bool {
+		return data.Users[i].Namespace+"/"+data.Users[i].Name < data.Users[j].Namespace+"/"+data.Users[j].Name
+	})
+	return data, nil
+}
+
+func serverConfigAccount(account *natsv1alpha1.NatsAccount) ServerConfigAccount {
+	return ServerConfigAccount{
+		Name:      account.Name,
+		Namespace: account.Namespace,
+		PublicKey: account.Status.PublicKey,
+		JWT:       account.Status.JWT,
+		Ready:     meta.IsStatusConditionTrue(account.Status.Conditions, natsv1alpha1.CONDITION_READY),
+	}
+}
+
+// trustedOperators resolves the operators trusted next to the given operator, skipping the operator itself and
+// duplicates. Invalid references are returned as a message to report in the status.
+func (r *NatsOperatorReconciler) trustedOperators(ctx context.Context, operator *natsv1alpha1.NatsOperator) ([]ServerConfigOperator, string, error) {
+	trusted := []ServerConfigOperator{}
+	publicKeys := map[string]bool{operator.Status.PublicKey: true}
+	for _, ref := range operator.Spec.TrustedOperators {
+		trustedOperator := ServerConfigOperator{JWT: ref.JWT}
+		if (ref.Name == "") == (ref.JWT == "") {
+			return nil, "a trusted operator requires either a name or a jwt", nil
+		}
+		if ref.Name != "" {
+			other := &natsv1alpha1.NatsOperator{}
+			if err := r.Get(ctx, client.ObjectKey{Namespace: operator.Namespace, Name: ref.Name}, other); errors.IsNotFound(err) {
+				// The operator watch enqueues us once it has been created
+				return nil, fmt.Sprintf("trusted operator %v not found", ref.Name), nil
+			} else if err != nil {
+				return nil, "", err
+			}
+			if other.Status.JWT == "" {
+				return nil, fmt.Sprintf("trusted operator %v has not been issued yet", ref.Name), nil
+			}
+			trustedOperator = ServerConfigOperator{Name: other.Name, Namespace: other.Namespace, JWT: other.Status.JWT}
+		}
+		claims, err := jwt.DecodeOperatorClaims(trustedOperator.JWT)
+		if err != nil {
+			return nil, fmt.Sprintf("invalid jwt of trusted operator: %v", err), nil
+		}
+		if publicKeys[claims.Subject] {
+			continue
+		}
+		publicKeys[claims.Subject] = true
+		trustedOperator.PublicKey = claims.Subject
+		trustedOperator.SigningKeys = claims.SigningKeys
+		trusted = append(trusted, trustedOperator)
+	}
+	return trusted, "", nil
+}
+
+// renderOperators renders the value of the operator directive, a list of all JWTs if further operators are trusted.
+func renderOperators(operatorJWT string, trusted []ServerConfigOperator) string {
+	if len(trusted) == 0 {
+		return operatorJWT
+	}
+	jwts := append([]string{operatorJWT}, lo.Map(trusted, func(operator ServerConfigOperator, _ int) string { return operator.JWT })...)
+	return "[\n\t" + strings.Join(jwts, ",\n\t") + "\n]"
+}
+
+// renderConfigTemplate renders the server configuration template, referencing missing fields is an error.
+func renderConfigTemplate(source string, data *ServerConfigData) (string, error) {
+	tmpl, err := template.New("config").Option("missingkey=error").Parse(source)
+	if err != nil {
+		return "", err
+	}
+	text := &strings.Builder{}
+	if err := tmpl.Execute(text, data); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+// configTemplateKey returns the key of the template in its ConfigMap.
+func configTemplateKey(configTemplate *natsv1alpha1.ConfigTemplate) string {
+	return lo.Ternary(configTemplate.Key == "", CONFIG_TEMPLATE_KEY, configTemplate.Key)
+}